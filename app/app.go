@@ -0,0 +1,384 @@
+package app
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hkensame/goken/pkg/errors"
+	"github.com/hkensame/goken/pkg/log"
+	"github.com/hkensame/goken/registry"
+
+	"github.com/oklog/run"
+)
+
+// Server是可以被App管理的服务,httpserver.Server与rpcserver.Server都实现了该接口
+type Server interface {
+	// Run接收请求,阻塞直到服务停止
+	Run(ctx context.Context) error
+	// SetNotServing让健康检查返回不可用,但依然正常处理请求,App在注销服务之前调用
+	SetNotServing()
+	// Shutdown优雅地停止服务,ctx结束后强制关闭,不会注销服务
+	Shutdown(ctx context.Context) error
+	// ServiceInstance返回需要注册的服务实例,返回nil表示不需要注册
+	ServiceInstance() *registry.ServiceInstance
+}
+
+// listener是需要在注册前绑定监听地址的服务,例如httpserver.Server
+type listener interface {
+	Listen() error
+}
+
+// Worker是随App一同启动与停止的后台任务,Run需要阻塞直到ctx结束,
+// 提前返回会导致整个App关闭
+type Worker interface {
+	Run(ctx context.Context) error
+}
+
+type WorkerFunc func(ctx context.Context) error
+
+func (f WorkerFunc) Run(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Hook是启动与关闭过程中执行的钩子,启动阶段的钩子返回error会终止启动,关闭阶段的钩子返回error只会被记录
+type Hook func(ctx context.Context) error
+
+var ErrAppStarted = errors.New("app已经运行过")
+
+// App统一管理进程内的http,grpc服务与后台任务,负责监听终止信号,服务注册与有序的启动关闭:
+//
+// 启动: BeforeStart钩子 -> 绑定监听地址 -> 启动服务与后台任务 -> 注册服务实例 -> AfterStart钩子
+//
+// 关闭: BeforeStop钩子 -> 健康检查置为不可用 -> 注销服务实例 -> 等待DrainDelay -> 逆序停止服务 -> 停止后台任务 -> AfterStop钩子
+//
+// 服务实例按id合并,同时提供http与grpc的服务可以通过WithServiceInstance共享一个实例或使用相同的服务id,
+// 所有监听地址绑定后只注册一次,endpoints包含所有服务的地址,
+// 由App管理的服务不应再设置自己的注册器,也不应调用它们的Serve
+type App struct {
+	ctx     context.Context
+	servers []Server
+	workers []Worker
+
+	registrar registry.Registor
+	//已经注册成功的服务实例id
+	registered []string
+
+	beforeStart []Hook
+	afterStart  []Hook
+	beforeStop  []Hook
+	afterStop   []Hook
+
+	signals []os.Signal
+	//注销服务后等待注册中心与客户端感知到变化的时间,只在存在注册器时等待
+	drainDelay time.Duration
+	//整个关闭过程的最长时间,超时后服务被强制关闭
+	shutdownTimeout time.Duration
+
+	started bool
+	//开始关闭后不再注册服务
+	stopping     bool
+	quit         chan struct{}
+	quitOnce     sync.Once
+	workerCancel context.CancelFunc
+	shutdownOnce sync.Once
+	lock         sync.Mutex
+}
+
+type OptionFunc func(*App)
+
+// App的根ctx,ctx结束时App开始关闭,默认为context.Background()
+func WithContext(ctx context.Context) OptionFunc {
+	return func(a *App) {
+		a.ctx = ctx
+	}
+}
+
+// 需要管理的服务,按照传入的顺序启动,逆序停止
+func WithServers(servers ...Server) OptionFunc {
+	return func(a *App) {
+		a.servers = append(a.servers, servers...)
+	}
+}
+
+// 需要管理的后台任务,在所有服务停止后才会停止
+func WithWorkers(workers ...Worker) OptionFunc {
+	return func(a *App) {
+		a.workers = append(a.workers, workers...)
+	}
+}
+
+// 用于注册所有服务实例的注册器,为nil时不注册
+func WithRegistrar(r registry.Registor) OptionFunc {
+	return func(a *App) {
+		a.registrar = r
+	}
+}
+
+func WithBeforeStart(hooks ...Hook) OptionFunc {
+	return func(a *App) {
+		a.beforeStart = append(a.beforeStart, hooks...)
+	}
+}
+
+func WithAfterStart(hooks ...Hook) OptionFunc {
+	return func(a *App) {
+		a.afterStart = append(a.afterStart, hooks...)
+	}
+}
+
+func WithBeforeStop(hooks ...Hook) OptionFunc {
+	return func(a *App) {
+		a.beforeStop = append(a.beforeStop, hooks...)
+	}
+}
+
+func WithAfterStop(hooks ...Hook) OptionFunc {
+	return func(a *App) {
+		a.afterStop = append(a.afterStop, hooks...)
+	}
+}
+
+// 触发关闭的信号,默认为SIGTERM与SIGINT
+func WithSignals(signals ...os.Signal) OptionFunc {
+	return func(a *App) {
+		a.signals = signals
+	}
+}
+
+// 注销服务后等待的时间,默认为3s
+func WithDrainDelay(d time.Duration) OptionFunc {
+	return func(a *App) {
+		a.drainDelay = d
+	}
+}
+
+// 整个关闭过程的最长时间,默认为30s
+func WithShutdownTimeout(d time.Duration) OptionFunc {
+	return func(a *App) {
+		a.shutdownTimeout = d
+	}
+}
+
+func New(opts ...OptionFunc) *App {
+	a := &App{
+		ctx:             context.Background(),
+		signals:         []os.Signal{syscall.SIGTERM, syscall.SIGINT},
+		drainDelay:      time.Second * 3,
+		shutdownTimeout: time.Second * 30,
+		quit:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Run启动所有服务与后台任务并阻塞,直到收到终止信号,调用Stop,根ctx结束或任意服务与后台任务退出,
+// 之后按顺序关闭并返回第一个导致退出的错误,收到信号或主动关闭时返回nil
+func (a *App) Run() error {
+	a.lock.Lock()
+	if a.started {
+		a.lock.Unlock()
+		return ErrAppStarted
+	}
+	a.started = true
+	a.lock.Unlock()
+
+	ctx := a.ctx
+	for _, h := range a.beforeStart {
+		if err := h(ctx); err != nil {
+			log.Errorf("[app] BeforeStart钩子执行失败 err = %v", err)
+			return err
+		}
+	}
+	//先绑定所有监听地址,地址被占用等错误会在启动任何服务之前暴露出来,
+	//同时保证注册时所有服务都已经可以接收连接
+	for _, s := range a.servers {
+		if l, ok := s.(listener); ok {
+			if err := l.Listen(); err != nil {
+				log.Errorf("[app] 绑定监听地址失败 err = %v", err)
+				return err
+			}
+		}
+	}
+
+	var wctx context.Context
+	wctx, a.workerCancel = context.WithCancel(ctx)
+	defer a.workerCancel()
+
+	g := &run.Group{}
+	for _, s := range a.servers {
+		g.Add(func() error {
+			return s.Run(ctx)
+		}, func(error) {
+			a.shutdown()
+		})
+	}
+	for _, w := range a.workers {
+		g.Add(func() error {
+			return w.Run(wctx)
+		}, func(error) {
+			a.shutdown()
+		})
+	}
+
+	//注册与AfterStart钩子在服务开始接收请求的同时执行,注册失败时关闭App
+	g.Add(func() error {
+		if err := a.register(ctx); err != nil {
+			return err
+		}
+		for _, h := range a.afterStart {
+			if err := h(ctx); err != nil {
+				log.Errorf("[app] AfterStart钩子执行失败 err = %v", err)
+				return err
+			}
+		}
+		sign := make(chan os.Signal, 1)
+		signal.Notify(sign, a.signals...)
+		defer signal.Stop(sign)
+		select {
+		case sig := <-sign:
+			log.Infof("[app] 收到信号%v,开始关闭", sig)
+		case <-ctx.Done():
+			log.Info("[app] ctx结束,开始关闭")
+		case <-a.quit:
+		}
+		return nil
+	}, func(error) {
+		a.Stop()
+		a.shutdown()
+	})
+
+	err := g.Run()
+
+	actx, cancel := context.WithTimeout(context.WithoutCancel(ctx), a.shutdownTimeout)
+	defer cancel()
+	for _, h := range a.afterStop {
+		if e := h(actx); e != nil {
+			log.Errorf("[app] AfterStop钩子执行失败 err = %v", e)
+		}
+	}
+	log.Info("[app] 已关闭")
+	return err
+}
+
+// Stop主动关闭App,可以在任意goroutine中多次调用
+func (a *App) Stop() {
+	a.quitOnce.Do(func() {
+		close(a.quit)
+	})
+}
+
+// instances按id合并所有服务的实例,id相同的实例(包括通过WithServiceInstance共享的实例)只会注册一次,
+// endpoints为它们的并集,其余字段以第一个服务的实例为准
+func (a *App) instances() []*registry.ServiceInstance {
+	var res []*registry.ServiceInstance
+	byID := make(map[string]*registry.ServiceInstance)
+	for _, s := range a.servers {
+		ins := s.ServiceInstance()
+		if ins == nil {
+			continue
+		}
+		merged, ok := byID[ins.ID]
+		if !ok {
+			merged = &registry.ServiceInstance{
+				ID:       ins.ID,
+				Name:     ins.Name,
+				Version:  ins.Version,
+				Metadata: make(map[string]string, len(ins.Metadata)),
+			}
+			byID[ins.ID] = merged
+			res = append(res, merged)
+		}
+		for k, v := range ins.Metadata {
+			if _, ok := merged.Metadata[k]; !ok {
+				merged.Metadata[k] = v
+			}
+		}
+		for _, e := range ins.Endpoints {
+			if !slices.ContainsFunc(merged.Endpoints, func(u *url.URL) bool { return u.String() == e.String() }) {
+				merged.Endpoints = append(merged.Endpoints, e)
+			}
+		}
+	}
+	return res
+}
+
+// register在所有服务绑定监听地址之后注册合并后的服务实例
+func (a *App) register(ctx context.Context) error {
+	if a.registrar == nil {
+		return nil
+	}
+	for _, ins := range a.instances() {
+		if err := a.registrar.Register(ctx, ins); err != nil {
+			log.Errorf("[app] 服务注册失败 id = %s, err = %v", ins.ID, err)
+			return err
+		}
+		a.lock.Lock()
+		stopping := a.stopping
+		if !stopping {
+			a.registered = append(a.registered, ins.ID)
+		}
+		a.lock.Unlock()
+		//注册的同时App已经开始关闭,立即注销
+		if stopping {
+			if err := a.registrar.Deregister(context.WithoutCancel(ctx), ins.ID); err != nil {
+				log.Errorf("[app] 服务注销失败 id = %s, err = %v", ins.ID, err)
+			}
+			return nil
+		}
+		log.Infof("[app] 服务注册成功 msg = %+v", ins)
+	}
+	return nil
+}
+
+// shutdown按照顺序关闭App,只会执行一次
+func (a *App) shutdown() {
+	a.shutdownOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(a.ctx), a.shutdownTimeout)
+		defer cancel()
+
+		for _, h := range a.beforeStop {
+			if err := h(ctx); err != nil {
+				log.Errorf("[app] BeforeStop钩子执行失败 err = %v", err)
+			}
+		}
+
+		//先让健康检查返回不可用,依赖健康检查的负载均衡器在注册中心传播变化期间就不再路由新请求
+		for _, s := range a.servers {
+			s.SetNotServing()
+		}
+
+		a.lock.Lock()
+		a.stopping = true
+		ids := a.registered
+		a.registered = nil
+		a.lock.Unlock()
+		for _, id := range ids {
+			if err := a.registrar.Deregister(ctx, id); err != nil {
+				log.Errorf("[app] 服务注销失败 id = %s, err = %v", id, err)
+			} else {
+				log.Infof("[app] 服务注销成功 id = %s", id)
+			}
+		}
+		if len(ids) > 0 && a.drainDelay > 0 {
+			select {
+			case <-time.After(a.drainDelay):
+			case <-ctx.Done():
+			}
+		}
+
+		for i := len(a.servers) - 1; i >= 0; i-- {
+			if err := a.servers[i].Shutdown(ctx); err != nil {
+				log.Errorf("[app] 服务停止失败 err = %v", err)
+			}
+		}
+		a.workerCancel()
+	})
+}
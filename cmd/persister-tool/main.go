@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"unicode/utf8"
+
+	"github.com/hkensame/goken/pkg/persister"
+	"github.com/hkensame/goken/pkg/persister/kv"
+)
+
+func Usage() {
+	s := `
+	persister-tool 用于检查与修复persister文件,具有以下几个子命令:
+		1. verify  <file>                    检查header与每个block的checksum,存在损坏时以非0状态退出
+		2. dump    [-json] <file>            输出header元数据、custom data、每个block的header与checksum状态以及解析出的entries
+		3. compact [-o out] <file>           重写文件以去除无用空间,kv文件会额外去除被覆盖与删除的数据,默认原地替换
+		4. salvage [-o out] [-force] <file>  把所有可读的entries拷贝到一个新文件中,默认输出为<file>.salvage
+
+	所有子命令都支持以下flag:
+		-key         十六进制的AES密钥,读取加密的block时必须提供,compact与salvage写出的文件也会使用该密钥加密
+		-compression compact与salvage写出文件时使用的压缩算法,可选none,snappy,zstd 默认为none
+	`
+	fmt.Println(s)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "verify":
+		err = runVerify(os.Args[2:])
+	case "dump":
+		err = runDump(os.Args[2:])
+	case "compact":
+		err = runCompact(os.Args[2:])
+	case "salvage":
+		err = runSalvage(os.Args[2:])
+	default:
+		Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "persister-tool %s 失败 err = %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+var (
+	opts        []persister.OptionFunc
+	keyHex      string
+	compression string
+)
+
+func parseArgs(fs *flag.FlagSet, args []string) (string, error) {
+	fs.Usage = Usage
+	fs.StringVar(&keyHex, "key", "", "十六进制的AES密钥")
+	fs.StringVar(&compression, "compression", "none", "写出文件时使用的压缩算法")
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		Usage()
+		return "", fmt.Errorf("需要且只需要指定一个persister文件")
+	}
+
+	if keyHex != "" {
+		key, err := hex.DecodeString(keyHex)
+		if err != nil {
+			return "", fmt.Errorf("密钥格式有误 err = %v", err)
+		}
+		opts = append(opts, persister.WithEncryptionKey(key))
+	}
+	switch compression {
+	case "none":
+	case "snappy":
+		opts = append(opts, persister.WithCompression(persister.TransformSnappy))
+	case "zstd":
+		opts = append(opts, persister.WithCompression(persister.TransformZstd))
+	default:
+		return "", fmt.Errorf("未知的压缩算法 %s", compression)
+	}
+	return fs.Arg(0), nil
+}
+
+type blockInfo struct {
+	BlockNum       int      `json:"blockNum"`
+	UsedSize       int      `json:"usedSize"`
+	EntryNums      int      `json:"entryNums"`
+	HeaderCheckSum uint32   `json:"headerCheckSum"`
+	BodyCheckSum   uint32   `json:"bodyCheckSum"`
+	Status         string   `json:"status"`
+	Transform      int16    `json:"transform"`
+	Error          string   `json:"error,omitempty"`
+	Entries        [][]byte `json:"entries,omitempty"`
+}
+
+const (
+	statusOK             = "ok"
+	statusChecksumFailed = "checksum_failed"
+	statusUnreadable     = "unreadable"
+)
+
+type fileInfo struct {
+	Path           string       `json:"path"`
+	BlockNums      int          `json:"blockNums"`
+	UsagedBlockNum int          `json:"usagedBlockNum"`
+	FileBlocks     int          `json:"fileBlocks"`
+	CustomData     []byte       `json:"customData,omitempty"`
+	IsKV           bool         `json:"isKV"`
+	Blocks         []*blockInfo `json:"blocks"`
+}
+
+// inspect读取文件中所有的block,blocks为需要读取的块数,为0时使用header中的UsagedBlockNum
+func inspect(bm *persister.BlockManager, path string, blocks int) (*fileInfo, error) {
+	fi := &fileInfo{
+		Path:           path,
+		BlockNums:      bm.BlockNums(),
+		UsagedBlockNum: bm.UsagedBlockNum(),
+	}
+	var err error
+	if fi.FileBlocks, err = bm.FileBlocks(); err != nil {
+		return nil, err
+	}
+	if fi.CustomData, err = bm.GetCustomData(); err != nil {
+		return nil, err
+	}
+	fi.IsKV = kv.IsKVFile(fi.CustomData)
+
+	if blocks == 0 {
+		blocks = fi.UsagedBlockNum
+	}
+	for i := 1; i <= blocks; i++ {
+		fi.Blocks = append(fi.Blocks, inspectBlock(bm, i))
+	}
+	return fi, nil
+}
+
+func inspectBlock(bm *persister.BlockManager, blocknum int) *blockInfo {
+	info := &blockInfo{BlockNum: blocknum, Status: statusOK}
+	b, err := bm.ReadBlockAt(blocknum)
+	if b == nil {
+		info.Status = statusUnreadable
+		info.Error = err.Error()
+		return info
+	}
+	if err != nil {
+		info.Status = statusChecksumFailed
+		info.Error = err.Error()
+	}
+	info.UsedSize = int(b.Header.UsedSize)
+	info.EntryNums = int(b.Header.EntryNums)
+	info.HeaderCheckSum = b.HeaderCheckSum
+	info.BodyCheckSum = b.BodyCheckSum
+	info.Transform = b.Header.Transform
+
+	entries, err := bm.BlockEntries(b)
+	if err != nil && info.Status == statusOK {
+		info.Status = statusUnreadable
+		info.Error = err.Error()
+	}
+	info.Entries = entries
+	return info
+}
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	bm, err := persister.OpenBlockManager(path, opts...)
+	if err != nil {
+		return err
+	}
+	defer bm.File.Close()
+
+	fi, err := inspect(bm, path, 0)
+	if err != nil {
+		return err
+	}
+	if fi.UsagedBlockNum < 1 || fi.UsagedBlockNum > fi.FileBlocks {
+		return fmt.Errorf("header中的UsagedBlockNum=%d与文件中的块数%d不符", fi.UsagedBlockNum, fi.FileBlocks)
+	}
+
+	bad := 0
+	for _, b := range fi.Blocks {
+		if b.Status != statusOK {
+			bad++
+			fmt.Printf("block %d: %s %s\n", b.BlockNum, b.Status, b.Error)
+		}
+	}
+	fmt.Printf("共检查%d个block,其中%d个损坏\n", len(fi.Blocks), bad)
+	if bad != 0 {
+		return fmt.Errorf("文件存在%d个损坏的block", bad)
+	}
+	return nil
+}
+
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "以json格式输出")
+	all := fs.Bool("all", false, "输出文件中实际存在的所有block而不只是header中记录的已使用block")
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	bm, err := persister.OpenBlockManager(path, opts...)
+	if err != nil {
+		return err
+	}
+	defer bm.File.Close()
+
+	blocks := 0
+	if *all {
+		if blocks, err = bm.FileBlocks(); err != nil {
+			return err
+		}
+	}
+	fi, err := inspect(bm, path, blocks)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(fi)
+	}
+
+	fmt.Printf("path: %s\nblockNums: %d\nusagedBlockNum: %d\nfileBlocks: %d\ncustomData: %s\nisKV: %v\n",
+		fi.Path, fi.BlockNums, fi.UsagedBlockNum, fi.FileBlocks, printable(fi.CustomData), fi.IsKV)
+	for _, b := range fi.Blocks {
+		fmt.Printf("\nblock %d: status=%s usedSize=%d entryNums=%d transform=%#x headerCheckSum=%08x bodyCheckSum=%08x\n",
+			b.BlockNum, b.Status, b.UsedSize, b.EntryNums, b.Transform, b.HeaderCheckSum, b.BodyCheckSum)
+		if b.Error != "" {
+			fmt.Printf("  error: %s\n", b.Error)
+		}
+		for i, e := range b.Entries {
+			fmt.Printf("  [%d] (%d bytes) %s\n", i, len(e), printable(e))
+		}
+	}
+	return nil
+}
+
+func printable(b []byte) string {
+	if utf8.Valid(b) {
+		return fmt.Sprintf("%q", b)
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// copyEntries把entries依次写入到一个新建的persister文件中,如果out已存在会被覆盖
+func copyEntries(out string, custom []byte, entries [][]byte) error {
+	if err := os.Remove(out); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	nbm := persister.MustNewBlockManager(out, 16, opts...)
+	if len(custom) != 0 {
+		if err := nbm.StoreCustomData(custom); err != nil {
+			nbm.Close()
+			return err
+		}
+	}
+	for _, e := range entries {
+		if err := nbm.WriteEntry(e); err != nil {
+			nbm.Close()
+			return err
+		}
+	}
+	return nbm.Close()
+}
+
+func runCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	out := fs.String("o", "", "输出文件,为空时原地替换")
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	bm, err := persister.OpenBlockManager(path, opts...)
+	if err != nil {
+		return err
+	}
+	fi, err := inspect(bm, path, 0)
+	bm.File.Close()
+	if err != nil {
+		return err
+	}
+	for _, b := range fi.Blocks {
+		if b.Status != statusOK {
+			return fmt.Errorf("block %d 已损坏,请先使用salvage修复", b.BlockNum)
+		}
+	}
+
+	if fi.IsKV {
+		db, err := kv.Open(path, kv.WithPersisterOptions(opts...))
+		if err != nil {
+			return err
+		}
+		if *out != "" {
+			err = db.Snapshot().Save(*out, 16, opts...)
+		} else {
+			err = db.Compact()
+		}
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+
+	var entries [][]byte
+	for _, b := range fi.Blocks {
+		entries = append(entries, b.Entries...)
+	}
+	target := *out
+	if target == "" {
+		target = path + ".compact"
+	}
+	if err := copyEntries(target, fi.CustomData, entries); err != nil {
+		return err
+	}
+	if *out == "" {
+		return os.Rename(target, path)
+	}
+	return nil
+}
+
+func runSalvage(args []string) error {
+	fs := flag.NewFlagSet("salvage", flag.ExitOnError)
+	out := fs.String("o", "", "输出文件,默认为<file>.salvage")
+	force := fs.Bool("force", false, "同时拷贝checksum失败但仍能解析出的entries")
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = path + ".salvage"
+	}
+
+	bm, err := persister.OpenBlockManager(path, opts...)
+	if err != nil {
+		return err
+	}
+	defer bm.File.Close()
+
+	// header可能已经损坏,因此扫描文件中实际存在的所有block
+	blocks, err := bm.FileBlocks()
+	if err != nil {
+		return err
+	}
+	fi, err := inspect(bm, path, blocks)
+	if err != nil {
+		return err
+	}
+
+	var (
+		entries [][]byte
+		skipped int
+	)
+	for _, b := range fi.Blocks {
+		// 超出header记录范围且从未写入过的block直接跳过
+		if b.BlockNum > fi.UsagedBlockNum && b.EntryNums == 0 {
+			continue
+		}
+		if b.Status == statusOK || (*force && b.Status == statusChecksumFailed) {
+			entries = append(entries, b.Entries...)
+			continue
+		}
+		skipped++
+		fmt.Printf("跳过block %d: %s %s\n", b.BlockNum, b.Status, b.Error)
+	}
+
+	if err := copyEntries(*out, fi.CustomData, entries); err != nil {
+		return err
+	}
+	fmt.Printf("已拷贝%d条entries到%s,跳过%d个block\n", len(entries), *out, skipped)
+	return nil
+}
@@ -0,0 +1,222 @@
+package authz
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hkensame/goken/kcasbin/proto"
+	kcasbin "github.com/hkensame/goken/kcasbin/server"
+	"github.com/hkensame/goken/pkg/errors"
+	"github.com/hkensame/goken/pkg/log"
+	kjwt "github.com/hkensame/goken/server/httpserver/middlewares/jwt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrPermissionDenied = errors.New("缺少访问该资源的权限")
+	ErrMissingSubject   = errors.New("请求中缺少访问主体")
+)
+
+// DecideFunc返回对req的鉴权结果,error表示无法得到结果(如kcasbin服务不可用),此时总是拒绝访问
+type DecideFunc func(ctx context.Context, req *proto.AuthorizeReq) (bool, error)
+
+// SubjectFunc从请求的ctx中读取访问主体
+type SubjectFunc func(ctx context.Context) (string, bool)
+
+// Authorizer把请求映射为(sub,dom,obj)交给kcasbin鉴权,sub默认取自jwt claims中的sub,
+// dom为服务名,obj在grpc中为FullMethod,在http中为method_path,
+// 鉴权结果会被短暂缓存,任何无法得到结果的情况都视为拒绝访问
+type Authorizer struct {
+	decide  DecideFunc
+	domain  string
+	subject SubjectFunc
+	//鉴权结果的缓存时间,小于等于0表示不缓存
+	cacheTTL time.Duration
+	//最多缓存的结果数
+	cacheSize int
+	//单次鉴权的超时时间
+	timeout time.Duration
+
+	cache map[string]decision
+	lock  sync.Mutex
+}
+
+type decision struct {
+	allowed  bool
+	expireAt time.Time
+}
+
+type OptionFunc func(*Authorizer)
+
+// 鉴权结果的缓存时间,默认为5s,小于等于0表示不缓存
+func WithCacheTTL(ttl time.Duration) OptionFunc {
+	return func(a *Authorizer) {
+		a.cacheTTL = ttl
+	}
+}
+
+// 最多缓存的鉴权结果数,默认为10000
+func WithCacheSize(n int) OptionFunc {
+	return func(a *Authorizer) {
+		a.cacheSize = n
+	}
+}
+
+// 单次鉴权的超时时间,默认为1s
+func WithTimeout(d time.Duration) OptionFunc {
+	return func(a *Authorizer) {
+		a.timeout = d
+	}
+}
+
+// 自定义读取访问主体的方式
+func WithSubject(fn SubjectFunc) OptionFunc {
+	return func(a *Authorizer) {
+		a.subject = fn
+	}
+}
+
+// MustNewAuthorizer使用decide鉴权,domain一般为服务名
+func MustNewAuthorizer(decide DecideFunc, domain string, opts ...OptionFunc) *Authorizer {
+	if decide == nil {
+		panic("[kcasbin] decide不能为空")
+	}
+	a := &Authorizer{
+		decide:    decide,
+		domain:    domain,
+		subject:   JWTSubject,
+		cacheTTL:  time.Second * 5,
+		cacheSize: 10000,
+		timeout:   time.Second,
+		cache:     make(map[string]decision),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// MustNewLocalAuthorizer在进程内直接使用k的enforcer鉴权,适用于嵌入了Kasbin的服务
+func MustNewLocalAuthorizer(k *kcasbin.Kasbin, domain string, opts ...OptionFunc) *Authorizer {
+	return MustNewAuthorizer(LocalDecider(k), domain, opts...)
+}
+
+// MustNewRemoteAuthorizer通过kcasbin服务的Authorize接口鉴权
+func MustNewRemoteAuthorizer(cli proto.AuthorizationClient, domain string, opts ...OptionFunc) *Authorizer {
+	return MustNewAuthorizer(RemoteDecider(cli), domain, opts...)
+}
+
+func LocalDecider(k *kcasbin.Kasbin) DecideFunc {
+	return func(ctx context.Context, req *proto.AuthorizeReq) (bool, error) {
+		return k.Casb.Enforce(req.Sub, req.Dom, req.Obj)
+	}
+}
+
+// RemoteDecider把PermissionDenied视为明确的拒绝,其余错误视为无法得到结果
+func RemoteDecider(cli proto.AuthorizationClient) DecideFunc {
+	return func(ctx context.Context, req *proto.AuthorizeReq) (bool, error) {
+		res, err := cli.Authorize(ctx, req)
+		if err != nil {
+			if status.Code(err) == codes.PermissionDenied {
+				return false, nil
+			}
+			return false, err
+		}
+		return res.GetOk(), nil
+	}
+}
+
+// JWTSubject从jwt claims的sub中读取访问主体
+func JWTSubject(ctx context.Context) (string, bool) {
+	claims, ok := kjwt.ClaimsFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	switch v := claims[kjwt.SubKey].(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, v != ""
+	case float64:
+		//json中的数字id会被解析为float64
+		return fmt.Sprintf("%.0f", v), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// Authorize判断ctx中的访问主体能否访问obj,不能访问时返回携带PermissionDenied错误码的错误
+func (a *Authorizer) Authorize(ctx context.Context, obj string) error {
+	sub, ok := a.subject(ctx)
+	if !ok {
+		return errors.WithCoder(ErrMissingSubject, errors.CodePermissionDenied, "")
+	}
+	if !a.Allow(ctx, sub, obj) {
+		return errors.WithCoder(ErrPermissionDenied, errors.CodePermissionDenied, "")
+	}
+	return nil
+}
+
+// Allow判断sub能否访问obj,鉴权失败时返回false
+func (a *Authorizer) Allow(ctx context.Context, sub, obj string) bool {
+	key := sub + "\x00" + a.domain + "\x00" + obj
+	if allowed, ok := a.load(key); ok {
+		return allowed
+	}
+
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+	allowed, err := a.decide(ctx, &proto.AuthorizeReq{Sub: sub, Dom: a.domain, Obj: obj})
+	if err != nil {
+		//无法得到结果时拒绝访问,且不缓存,以便kcasbin恢复后立即生效
+		log.ErrorfContext(ctx, "[kcasbin] 鉴权失败 sub = %s, dom = %s, obj = %s, err = %v", sub, a.domain, obj, err)
+		return false
+	}
+	a.store(key, allowed)
+	return allowed
+}
+
+func (a *Authorizer) load(key string) (bool, bool) {
+	if a.cacheTTL <= 0 {
+		return false, false
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	d, ok := a.cache[key]
+	if !ok {
+		return false, false
+	}
+	if time.Now().After(d.expireAt) {
+		delete(a.cache, key)
+		return false, false
+	}
+	return d.allowed, true
+}
+
+func (a *Authorizer) store(key string, allowed bool) {
+	if a.cacheTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.cache) >= a.cacheSize {
+		for k, d := range a.cache {
+			if now.After(d.expireAt) {
+				delete(a.cache, k)
+			}
+		}
+		//没有过期的结果可以清理时直接丢弃全部缓存
+		if len(a.cache) >= a.cacheSize {
+			a.cache = make(map[string]decision)
+		}
+	}
+	a.cache[key] = decision{allowed: allowed, expireAt: now.Add(a.cacheTTL)}
+}
@@ -0,0 +1,46 @@
+package authz
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/hkensame/goken/pkg/common/httputil"
+	"github.com/hkensame/goken/server/rpcserver/sinterceptors"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+)
+
+// AuthFunc以FullMethod为obj鉴权,可以通过rpcserver.WithAuth注册,需要在jwt认证之后执行
+func (a *Authorizer) AuthFunc() sinterceptors.AuthFunc {
+	return func(ctx context.Context, fullMethod string) (context.Context, error) {
+		if err := a.Authorize(ctx, fullMethod); err != nil {
+			return nil, err
+		}
+		return ctx, nil
+	}
+}
+
+// UnaryServerInterceptor对一元请求鉴权,健康检查,反射与skipMethods中的方法不需要鉴权
+func (a *Authorizer) UnaryServerInterceptor(skipMethods ...string) grpc.UnaryServerInterceptor {
+	return sinterceptors.UnaryAuthInterceptor(a.AuthFunc(), skipMethods...)
+}
+
+// StreamServerInterceptor在流建立时鉴权,健康检查,反射与skipMethods中的方法不需要鉴权
+func (a *Authorizer) StreamServerInterceptor(skipMethods ...string) grpc.StreamServerInterceptor {
+	return sinterceptors.StreamAuthInterceptor(a.AuthFunc(), skipMethods...)
+}
+
+// GinHandler以method_path(如GET_/v1/users/:id)为obj鉴权,path为注册的路由而不是实际的url,
+// 未匹配到路由的请求使用实际的url,需要放在jwt中间件之后
+func (a *Authorizer) GinHandler(c *gin.Context) {
+	path := c.FullPath()
+	if path == "" {
+		path = c.Request.URL.Path
+	}
+	if err := a.Authorize(c, c.Request.Method+"_"+path); err != nil {
+		httputil.WriteError(c, http.StatusForbidden, err, true)
+		return
+	}
+	c.Next()
+}
@@ -142,7 +142,11 @@ func (s *Kasbin) Authorize(ctx context.Context, in *proto.AuthorizeReq) (*proto.
 			s.Logger.Sugar().Errorf("[kcasbin] 授权失败: %v", err)
 		}
 		res.Detail = fmt.Sprintf("用户[%s] 对资源[%s:%s]授权失败", in.Sub, in.Dom, in.Obj)
-		return res, ErrAuthorizedFailed
+		if err != nil {
+			return res, ErrAuthorizedFailed
+		}
+		//明确的拒绝返回PermissionDenied,从而与enforcer出错区分开
+		return res, errors.WithCoder(ErrAuthorizedFailed, errors.CodePermissionDenied, "")
 	}
 	res.Detail = fmt.Sprintf("用户[%s] 对资源[%s:%s] 授权结果: %v", in.Sub, in.Dom, in.Obj, ok)
 	return res, nil
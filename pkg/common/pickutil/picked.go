@@ -0,0 +1,38 @@
+package pickutil
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Picked保存一次请求被负载均衡器选中的实例地址,由负载均衡器写入,由客户端拦截器读取,
+// 该地址即resolver推送的resolver.Address.Addr,与peer中实际连接的地址不一定相同
+type Picked struct {
+	addr atomic.Pointer[string]
+}
+
+type pickedKey struct{}
+
+// NewContext返回携带p的ctx,使用该ctx发起的请求选中实例后地址会被写入p
+func NewContext(ctx context.Context, p *Picked) context.Context {
+	return context.WithValue(ctx, pickedKey{}, p)
+}
+
+// FromContext返回ctx中携带的Picked
+func FromContext(ctx context.Context) (*Picked, bool) {
+	p, ok := ctx.Value(pickedKey{}).(*Picked)
+	return p, ok
+}
+
+// Addr返回选中的实例地址,没有经过负载均衡器写入时返回空字符串
+func (p *Picked) Addr() string {
+	if a := p.addr.Load(); a != nil {
+		return *a
+	}
+	return ""
+}
+
+// SetAddr记录选中的实例地址,由负载均衡器在选中实例后调用
+func (p *Picked) SetAddr(addr string) {
+	p.addr.Store(&addr)
+}
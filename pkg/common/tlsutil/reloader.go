@@ -0,0 +1,195 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hkensame/goken/pkg/errors"
+	"github.com/hkensame/goken/pkg/log"
+)
+
+// Reloader从磁盘读取证书,私钥与CA,文件被替换后会在下一次握手时自动重新加载,
+// 因此证书轮换时无需重启服务,重新加载失败时继续使用上一次成功加载的证书
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	//两次检查文件是否变化的最小间隔
+	interval time.Duration
+
+	cert *tls.Certificate
+	pool *x509.CertPool
+	//上一次加载时各文件的修改时间与大小
+	stamp     string
+	lastCheck time.Time
+	lock      sync.Mutex
+}
+
+type OptionFunc func(*Reloader)
+
+// 两次检查证书文件是否变化的最小间隔,默认为10s
+func WithCheckInterval(d time.Duration) OptionFunc {
+	return func(r *Reloader) {
+		r.interval = d
+	}
+}
+
+// certFile与keyFile为空时不加载证书(只作为客户端校验服务端时使用),caFile为空时使用系统的根证书,
+// 首次加载失败时panic
+func MustNewReloader(certFile, keyFile, caFile string, opts ...OptionFunc) *Reloader {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		interval: time.Second * 10,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if (certFile == "") != (keyFile == "") {
+		panic(errors.New("证书与私钥必须同时设置"))
+	}
+	if err := r.load(); err != nil {
+		panic(err)
+	}
+	r.lastCheck = time.Now()
+	return r
+}
+
+// Certificate返回当前的证书,未设置证书时返回nil
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.maybeReload()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.cert
+}
+
+// CAPool返回当前的CA证书池,未设置CA时返回nil
+func (r *Reloader) CAPool() *x509.CertPool {
+	r.maybeReload()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.pool
+}
+
+// ServerConfig返回服务端使用的tls.Config,设置了CA时要求客户端提供由该CA签发的证书(mTLS)
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert := r.Certificate()
+			if cert == nil {
+				return nil, errors.New("服务端未设置证书")
+			}
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				NextProtos:   []string{"h2"},
+			}
+			if pool := r.CAPool(); pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// ClientConfig返回客户端使用的tls.Config,serverName为空时使用连接的目标地址校验服务端证书,
+// 设置了证书时会在服务端要求时提供该证书(mTLS)
+func (r *Reloader) ClientConfig(serverName string) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if r.certFile != "" {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.Certificate(), nil
+		}
+	}
+	if r.caFile != "" {
+		//RootCAs在握手前就被固定,为了在CA变化后立即生效,这里跳过默认校验并使用当前的CA手动校验
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("服务端未提供证书")
+			}
+			opts := x509.VerifyOptions{
+				Roots:         r.CAPool(),
+				DNSName:       cs.ServerName,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+	return cfg
+}
+
+func (r *Reloader) maybeReload() {
+	r.lock.Lock()
+	if time.Since(r.lastCheck) < r.interval {
+		r.lock.Unlock()
+		return
+	}
+	r.lastCheck = time.Now()
+	changed := r.fileStamp() != r.stamp
+	r.lock.Unlock()
+
+	if changed {
+		if err := r.load(); err != nil {
+			log.Errorf("[tls] 重新加载证书失败,继续使用原有证书 err = %v", err)
+			return
+		}
+		log.Infof("[tls] 重新加载证书 cert = %s, ca = %s", r.certFile, r.caFile)
+	}
+}
+
+func (r *Reloader) load() error {
+	stamp := r.fileStamp()
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return errors.Wrapf(err, "加载证书%s失败", r.certFile)
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		data, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return errors.Wrapf(err, "读取CA%s失败", r.caFile)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.Errorf("CA%s中没有有效的证书", r.caFile)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert, r.pool, r.stamp = cert, pool, stamp
+	return nil
+}
+
+// fileStamp由各文件的修改时间与大小组成,任何一个文件变化都会导致结果不同
+func (r *Reloader) fileStamp() string {
+	stamp := ""
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f == "" {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil {
+			stamp += fmt.Sprintf("%d:%d;", fi.ModTime().UnixNano(), fi.Size())
+		}
+	}
+	return stamp
+}
@@ -239,3 +239,9 @@ func NewHashFuncForPBKDF2WithDefault(algorithm string) (func() hash.Hash, string
 		return sha512.New, defaultHashAlgorithm
 	}
 }
+
+// DeriveKey使用PBKDF2从口令中派生出固定长度的密钥,可用于AES等对称加密
+// 同样的secret与salt总是得到同样的密钥,salt需要与加密数据分开保存
+func DeriveKey(secret, salt []byte, keyLen int) []byte {
+	return pbkdf2.Key(secret, salt, defaultIterations*100, keyLen, sha256.New)
+}
@@ -0,0 +1,119 @@
+package idempotency
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/hkensame/goken/pkg/common/httputil"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 不随响应一起保存的header
+var skippedHeaders = map[string]struct{}{
+	"Date":           {},
+	"Content-Length": {},
+	"Set-Cookie":     {},
+}
+
+// GinHandler对带有Idempotency-Key请求头的请求生效,幂等键的作用域为method_path与访问主体,需要放在jwt中间件之后,
+// 相同幂等键的重复请求直接重放保存的响应,处理中的重复请求返回409,url或body不同的重复请求返回422,
+// 5xx以及401,403,408,429的响应不会被保存,之后的重复请求会再次被处理
+func (i *Idempotency) GinHandler(c *gin.Context) {
+	key := c.GetHeader(HeaderKey)
+	if key == "" {
+		c.Next()
+		return
+	}
+	path := c.FullPath()
+	if path == "" {
+		path = c.Request.URL.Path
+	}
+	body, err := readBody(c)
+	if err != nil {
+		httputil.WriteError(c, http.StatusBadRequest, err, true)
+		return
+	}
+	fp := Fingerprint([]byte(c.Request.Method), []byte(c.Request.URL.RequestURI()), body)
+
+	rec, replayed, err := i.Do(c, c.Request.Method+"_"+path, key, fp, func() (*Record, bool) {
+		w := &recordWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		//之后的handler panic时外层的Recovery依然需要原始的Writer
+		defer func() { c.Writer = w.ResponseWriter }()
+		c.Next()
+
+		rec := &Record{Status: w.Status(), Header: make(map[string][]string), Body: w.body.Bytes()}
+		for k, v := range w.Header() {
+			if _, ok := skippedHeaders[k]; !ok {
+				rec.Header[k] = v
+			}
+		}
+		return rec, saveStatus(rec.Status)
+	})
+	switch err {
+	case nil:
+	case ErrInFlight:
+		httputil.WriteError(c, http.StatusConflict, err, true)
+		return
+	case ErrKeyTooLong:
+		httputil.WriteError(c, http.StatusBadRequest, err, true)
+		return
+	case ErrKeyReused:
+		httputil.WriteError(c, http.StatusUnprocessableEntity, err, true)
+		return
+	default:
+		httputil.WriteError(c, http.StatusServiceUnavailable, err, true)
+		return
+	}
+	if !replayed {
+		return
+	}
+
+	for k, v := range rec.Header {
+		c.Writer.Header()[k] = v
+	}
+	c.Writer.Header().Set(ReplayedHeader, "true")
+	c.Writer.WriteHeader(rec.Status)
+	c.Writer.Write(rec.Body)
+	c.Abort()
+}
+
+// readBody读出请求的body并放回,之后的handler依然可以读取
+func readBody(c *gin.Context) ([]byte, error) {
+	if c.Request.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	c.Request.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+func saveStatus(code int) bool {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return code < http.StatusInternalServerError
+}
+
+// recordWriter在写出响应的同时保存一份body
+type recordWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
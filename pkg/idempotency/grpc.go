@@ -0,0 +1,120 @@
+package idempotency
+
+import (
+	"context"
+	"strings"
+
+	"github.com/hkensame/goken/pkg/log"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// 业务上确定的错误,重复请求得到的结果相同,因此与成功的响应一样会被保存
+var savedCodes = map[codes.Code]struct{}{
+	codes.InvalidArgument:    {},
+	codes.NotFound:           {},
+	codes.AlreadyExists:      {},
+	codes.FailedPrecondition: {},
+	codes.OutOfRange:         {},
+}
+
+// UnaryServerInterceptor对incoming metadata中带有idempotency-key的一元请求生效,幂等键的作用域为FullMethod与访问主体,
+// 需要放在jwt认证之后,相同幂等键的重复请求直接重放保存的响应或错误,处理中的重复请求返回Aborted,
+// 请求内容不同的重复请求返回InvalidArgument,
+// 重放的响应会在header中带上idempotent-replayed: true
+func (i *Idempotency) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		vals := md.Get(MetadataKey)
+		if len(vals) == 0 || vals[0] == "" {
+			return handler(ctx, req)
+		}
+
+		var fp string
+		if m, ok := req.(proto.Message); ok {
+			data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			fp = Fingerprint(data)
+		}
+
+		var resp any
+		var herr error
+		rec, replayed, err := i.Do(ctx, info.FullMethod, vals[0], fp, func() (*Record, bool) {
+			resp, herr = handler(ctx, req)
+			return marshalResult(resp, herr)
+		})
+		switch err {
+		case nil:
+		case ErrInFlight:
+			return nil, status.Error(codes.Aborted, err.Error())
+		case ErrKeyTooLong, ErrKeyReused:
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		default:
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		if !replayed {
+			return resp, herr
+		}
+
+		grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(ReplayedHeader), "true"))
+		return unmarshalResult(rec)
+	}
+}
+
+// marshalResult把响应序列化为Any,把需要保存的错误序列化为status
+func marshalResult(resp any, err error) (*Record, bool) {
+	if err != nil {
+		st := status.Convert(err)
+		if _, ok := savedCodes[st.Code()]; !ok {
+			return nil, false
+		}
+		data, merr := proto.Marshal(st.Proto())
+		if merr != nil {
+			return nil, false
+		}
+		return &Record{Status: int(st.Code()), Body: data}, true
+	}
+	m, ok := resp.(proto.Message)
+	if !ok {
+		return nil, false
+	}
+	a, merr := anypb.New(m)
+	if merr != nil {
+		return nil, false
+	}
+	data, merr := proto.Marshal(a)
+	if merr != nil {
+		return nil, false
+	}
+	return &Record{Body: data}, true
+}
+
+func unmarshalResult(rec *Record) (any, error) {
+	if codes.Code(rec.Status) != codes.OK {
+		st := &spb.Status{}
+		if err := proto.Unmarshal(rec.Body, st); err != nil {
+			log.Errorf("[idempotency] 解析保存的错误失败 err = %v", err)
+			return nil, status.Error(codes.Internal, ErrStoreFailed.Error())
+		}
+		return nil, status.ErrorProto(st)
+	}
+	a := &anypb.Any{}
+	if err := proto.Unmarshal(rec.Body, a); err != nil {
+		log.Errorf("[idempotency] 解析保存的响应失败 err = %v", err)
+		return nil, status.Error(codes.Internal, ErrStoreFailed.Error())
+	}
+	m, err := a.UnmarshalNew()
+	if err != nil {
+		log.Errorf("[idempotency] 解析保存的响应失败 err = %v", err)
+		return nil, status.Error(codes.Internal, ErrStoreFailed.Error())
+	}
+	return m, nil
+}
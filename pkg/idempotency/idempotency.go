@@ -0,0 +1,253 @@
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/hkensame/goken/pkg/errors"
+	"github.com/hkensame/goken/pkg/log"
+	"github.com/hkensame/goken/pkg/redlock"
+	kjwt "github.com/hkensame/goken/server/httpserver/middlewares/jwt"
+
+	"github.com/go-redsync/redsync/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// http请求头与grpc metadata中携带幂等键的key
+const (
+	HeaderKey   = "Idempotency-Key"
+	MetadataKey = "idempotency-key"
+	// 重放的响应会带上该header
+	ReplayedHeader = "Idempotent-Replayed"
+)
+
+var (
+	// 相同幂等键的请求正在处理中
+	ErrInFlight = errors.New("相同幂等键的请求正在处理中")
+	// 读写redis或获取分布式锁时出错
+	ErrStoreFailed = errors.New("幂等记录读写失败")
+	// 幂等键超过了最大长度
+	ErrKeyTooLong = errors.New("幂等键过长")
+	// 相同的幂等键被用于内容不同的请求
+	ErrKeyReused = errors.New("幂等键已被用于内容不同的请求")
+)
+
+// Record是一次请求的最终结果,http中为状态码,header与body,grpc中为序列化后的响应
+type Record struct {
+	Status int                 `json:"status,omitempty"`
+	Header map[string][]string `json:"header,omitempty"`
+	Body   []byte              `json:"body"`
+	// 请求内容的哈希,重复请求的内容与之不同时返回ErrKeyReused
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// SubjectFunc从请求的ctx中读取访问主体,幂等键只在同一个访问主体内生效
+type SubjectFunc func(ctx context.Context) string
+
+// Idempotency保证带有相同幂等键的请求只被处理一次,处理中的标记为pkg/redlock的分布式锁,
+// 最终结果保存在redis中,之后的重复请求直接重放保存的结果
+type Idempotency struct {
+	rdb  redis.UniversalClient
+	lock *redlock.RedLock
+	//redis key的前缀
+	prefix string
+	//结果的保存时间
+	ttl time.Duration
+	//处理中标记的过期时间,处理时长超过该时间后重复请求会再次被处理
+	lockTTL time.Duration
+	//幂等键的最大长度
+	maxKeyLen int
+	subject   SubjectFunc
+}
+
+type OptionFunc func(*Idempotency)
+
+// redis key的前缀,默认为goken:idempotency:
+func WithPrefix(prefix string) OptionFunc {
+	return func(i *Idempotency) {
+		i.prefix = prefix
+	}
+}
+
+// 结果的保存时间,默认为24h
+func WithTTL(ttl time.Duration) OptionFunc {
+	return func(i *Idempotency) {
+		i.ttl = ttl
+	}
+}
+
+// 处理中标记的过期时间,默认为30s,需要大于请求的最长处理时间
+func WithLockTTL(ttl time.Duration) OptionFunc {
+	return func(i *Idempotency) {
+		i.lockTTL = ttl
+	}
+}
+
+// 幂等键的最大长度,默认为128
+func WithMaxKeyLen(n int) OptionFunc {
+	return func(i *Idempotency) {
+		i.maxKeyLen = n
+	}
+}
+
+// 自定义读取访问主体的方式,默认取jwt claims中的sub,没有认证信息的请求共享同一个作用域
+func WithSubject(fn SubjectFunc) OptionFunc {
+	return func(i *Idempotency) {
+		i.subject = fn
+	}
+}
+
+func MustNewIdempotency(rdb redis.UniversalClient, lock *redlock.RedLock, opts ...OptionFunc) *Idempotency {
+	if rdb == nil || lock == nil {
+		panic("[idempotency] redis与redlock不能为空")
+	}
+	i := &Idempotency{
+		rdb:       rdb,
+		lock:      lock,
+		prefix:    "goken:idempotency:",
+		ttl:       time.Hour * 24,
+		lockTTL:   time.Second * 30,
+		maxKeyLen: 128,
+		subject:   JWTSubject,
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+// JWTSubject从jwt claims的sub中读取访问主体
+func JWTSubject(ctx context.Context) string {
+	claims, ok := kjwt.ClaimsFromContext(ctx)
+	if !ok {
+		return ""
+	}
+	switch v := claims[kjwt.SubKey].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		//json中的数字id会被解析为float64
+		return fmt.Sprintf("%.0f", v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Fingerprint返回请求内容的哈希,用于识别复用了幂等键的不同请求
+func Fingerprint(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		//写入长度避免不同的切分得到相同的哈希
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(p))))
+		h.Write(p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Do以scope+访问主体+key为幂等键执行fn,已有结果时直接返回保存的结果且replayed为true,
+// 保存的结果与fingerprint不一致时返回ErrKeyReused,fingerprint为空表示不校验,
+// 相同幂等键的请求正在处理时返回ErrInFlight,fn返回的save为false时结果不会被保存,之后的重复请求会再次执行fn,
+// fn执行期间会持续延长处理中标记的过期时间
+func (i *Idempotency) Do(ctx context.Context, scope, key, fingerprint string, fn func() (rec *Record, save bool)) (rec *Record, replayed bool, err error) {
+	if len(key) > i.maxKeyLen {
+		return nil, false, ErrKeyTooLong
+	}
+	//访问主体由调用者控制,需要转义其中的分隔符
+	rkey := i.prefix + scope + ":" + url.QueryEscape(i.subject(ctx)) + ":" + key
+	if rec, err := i.load(ctx, rkey, fingerprint); err != nil || rec != nil {
+		return rec, rec != nil, err
+	}
+
+	//只尝试一次,拿不到锁说明相同的请求正在处理中,锁的key与pkg/redlock的约定相同
+	mtx := i.lock.NewMutex(rkey+"-lock", redsync.WithExpiry(i.lockTTL))
+	if err := mtx.TryLockContext(ctx); err != nil {
+		var taken *redsync.ErrTaken
+		if errors.Is(err, redsync.ErrFailed) || errors.As(err, &taken) {
+			return nil, false, ErrInFlight
+		}
+		log.ErrorfContext(ctx, "[idempotency] 获取分布式锁失败 key = %s, err = %v", rkey, err)
+		return nil, false, ErrStoreFailed
+	}
+	defer func() {
+		//使用独立的ctx,请求被取消时也要释放锁
+		if _, err := mtx.UnlockContext(context.WithoutCancel(ctx)); err != nil {
+			log.WarnfContext(ctx, "[idempotency] 释放分布式锁失败 key = %s, err = %v", rkey, err)
+		}
+	}()
+
+	//拿到锁之前上一个请求可能刚好处理完成
+	if rec, err := i.load(ctx, rkey, fingerprint); err != nil || rec != nil {
+		return rec, rec != nil, err
+	}
+
+	rec, save := func() (*Record, bool) {
+		//fn panic时也要停止延长,否则会在释放后的锁上一直尝试延长
+		defer i.extend(ctx, mtx, rkey)()
+		return fn()
+	}()
+	if save && rec != nil {
+		rec.Fingerprint = fingerprint
+		data, err := json.Marshal(rec)
+		if err == nil {
+			err = i.rdb.Set(context.WithoutCancel(ctx), rkey, data, i.ttl).Err()
+		}
+		if err != nil {
+			//请求已经处理完成,保存失败只影响之后的重放
+			log.ErrorfContext(ctx, "[idempotency] 保存结果失败 key = %s, err = %v", rkey, err)
+		}
+	}
+	return rec, false, nil
+}
+
+// extend每隔lockTTL/3延长一次锁的过期时间,避免处理时间较长的请求被重复处理,返回的函数用于停止延长
+func (i *Idempotency) extend(ctx context.Context, mtx *redsync.Mutex, rkey string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(max(i.lockTTL/3, time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if ok, err := mtx.ExtendContext(context.WithoutCancel(ctx)); !ok || err != nil {
+					log.WarnfContext(ctx, "[idempotency] 延长分布式锁失败 key = %s, err = %v", rkey, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (i *Idempotency) load(ctx context.Context, rkey, fingerprint string) (*Record, error) {
+	data, err := i.rdb.Get(ctx, rkey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		log.ErrorfContext(ctx, "[idempotency] 读取结果失败 key = %s, err = %v", rkey, err)
+		return nil, ErrStoreFailed
+	}
+	rec := &Record{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		log.ErrorfContext(ctx, "[idempotency] 解析结果失败 key = %s, err = %v", rkey, err)
+		return nil, ErrStoreFailed
+	}
+	if fingerprint != "" && rec.Fingerprint != "" && rec.Fingerprint != fingerprint {
+		return nil, ErrKeyReused
+	}
+	return rec, nil
+}
@@ -0,0 +1,201 @@
+package idempotency
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hkensame/goken/pkg/redlock"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeRedis是只实现了幂等与redsync所需命令的redis,extends记录尝试延长锁的次数
+type fakeRedis struct {
+	mu      sync.Mutex
+	kv      map[string]string
+	extends atomic.Int64
+}
+
+func startFakeRedis(t *testing.T) (*fakeRedis, string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	f := &fakeRedis{kv: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, lis.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, f.exec(args)); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		v, ok := f.kv[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		if _, ok := f.kv[args[1]]; ok && strings.Contains(strings.ToUpper(strings.Join(args[3:], " ")), "NX") {
+			return "$-1\r\n"
+		}
+		f.kv[args[1]] = args[2]
+		return "+OK\r\n"
+	case "EVALSHA":
+		return "-NOSCRIPT No matching script\r\n"
+	case "EVAL":
+		//redsync的脚本都是在值与ARGV[1]相同时删除或延长key
+		key, value := args[3], args[4]
+		extend := strings.Contains(args[1], "PEXPIRE")
+		if extend {
+			f.extends.Add(1)
+		}
+		if f.kv[key] != value {
+			return ":0\r\n"
+		}
+		if !extend {
+			delete(f.kv, key)
+		}
+		return ":1\r\n"
+	case "HELLO":
+		return "-ERR unknown command\r\n"
+	}
+	return "+OK\r\n"
+}
+
+func newTestIdempotency(t *testing.T, lockTTL time.Duration) (*Idempotency, *fakeRedis) {
+	t.Helper()
+	f, addr := startFakeRedis(t)
+	rdb := redis.NewClient(&redis.Options{Addr: addr, Protocol: 2})
+	t.Cleanup(func() { rdb.Close() })
+	return MustNewIdempotency(rdb, redlock.MustNewRedLock([]string{addr}), WithLockTTL(lockTTL)), f
+}
+
+// waitExtendStopped确认一段时间内没有再延长锁
+func waitExtendStopped(t *testing.T, f *fakeRedis, lockTTL time.Duration) {
+	t.Helper()
+	n := f.extends.Load()
+	time.Sleep(lockTTL)
+	if got := f.extends.Load(); got != n {
+		t.Fatalf("fn结束后依然在延长锁 before = %d, after = %d", n, got)
+	}
+}
+
+func TestDoPanic(t *testing.T) {
+	lockTTL := time.Millisecond * 90
+	i, f := newTestIdempotency(t, lockTTL)
+	ctx := context.Background()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("fn的panic应当传递给调用者")
+			}
+		}()
+		i.Do(ctx, "scope", "k1", "", func() (*Record, bool) {
+			time.Sleep(lockTTL / 2)
+			panic("boom")
+		})
+	}()
+	if f.extends.Load() == 0 {
+		t.Fatal("fn执行期间没有延长锁")
+	}
+	waitExtendStopped(t, f, lockTTL)
+
+	//锁已经释放,相同的幂等键可以再次执行
+	rec, replayed, err := i.Do(ctx, "scope", "k1", "", func() (*Record, bool) {
+		return &Record{Status: http.StatusOK}, true
+	})
+	if err != nil || replayed || rec.Status != http.StatusOK {
+		t.Fatalf("rec = %+v, replayed = %v, err = %v", rec, replayed, err)
+	}
+}
+
+func TestGinHandlerPanic(t *testing.T) {
+	lockTTL := time.Millisecond * 90
+	i, f := newTestIdempotency(t, lockTTL)
+
+	var restored bool
+	e := gin.New()
+	e.Use(func(c *gin.Context) {
+		w := c.Writer
+		defer func() { restored = c.Writer == w }()
+		c.Next()
+	}, gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, _ any) {
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}), i.GinHandler)
+	e.POST("/panic", func(c *gin.Context) {
+		time.Sleep(lockTTL / 2)
+		panic("boom")
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/panic", strings.NewReader("{}"))
+	req.Header.Set(HeaderKey, "k1")
+	e.ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d", w.Code)
+	}
+	if !restored {
+		t.Fatal("panic后c.Writer没有被还原")
+	}
+	waitExtendStopped(t, f, lockTTL)
+}
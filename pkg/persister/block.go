@@ -1,6 +1,7 @@
 package persister
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"os"
 	"unsafe"
@@ -28,6 +29,7 @@ var (
 	ErrReadFailed      = errors.New("数据读取失败")
 	ErrUnmarshalFailed = errors.New("给定的二进制数据反序列化失败")
 	ErrChecksumFailed  = errors.New("读出的数据可能有误,无法经过checksum")
+	ErrEntryTooLarge   = errors.New("entry过大,无法放入一个block中")
 )
 
 type BlockEntry struct {
@@ -42,7 +44,8 @@ type BlockHeader struct {
 	BlockNum int16
 	// 现在已经存储的条目数
 	EntryNums int16
-	Align     int16
+	// 该块body使用的transform,为TransformNone时body即为原始的entries数据
+	Transform int16
 }
 
 // 因为block总共被固定为4k字节,所以里面的字段使用int16是安全的
@@ -69,10 +72,18 @@ type BlockManager struct {
 	//读取时会把老的block读入到这个切片中
 	Blocks      []Block
 	UsagedBlock *Block
+	// 正在使用的块中还未经过transform的entries数据,只有在落盘时才会编码到UsagedBlock中
+	plain []byte
+
+	// 新写入的块使用的压缩算法与加密方式,读取时则以每个块header中记录的transform为准
+	compression int16
+	aead        cipher.AEAD
 
 	dirty bool
 }
 
+type OptionFunc func(*BlockManager)
+
 func newBlockEntry(b []byte) *BlockEntry {
 	return &BlockEntry{
 		Data:      b,
@@ -90,38 +101,61 @@ func (be *BlockEntry) encode() []byte {
 // 写了一个脆弱的读取系统,不要修改文件内的内容
 // 必知:该persister提供了基本的写block和读block,如果希望强一致性就在每次写的时候调用flush
 // 整个包不提供锁和并发安全保障,请将persister当做一种需要锁的资源
-func MustNewBlockManager(path string, blocks int) *BlockManager {
+func MustNewBlockManager(path string, blocks int, opts ...OptionFunc) *BlockManager {
+	bm, err := NewBlockManager(path, blocks, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return bm
+}
+
+// NewBlockManager与MustNewBlockManager相同,但在文件无法打开或初始化失败时返回错误而不是panic
+func NewBlockManager(path string, blocks int, opts ...OptionFunc) (*BlockManager, error) {
 	bm := &BlockManager{
 		md:          new(metadata),
 		UsagedBlock: &Block{},
 	}
+	for _, opt := range opts {
+		opt(bm)
+	}
 	bm.md.BlockNums = int32(blocks)
 
 	var err error
 	bm.File, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	//如果文件是第一次写入或者数据不对就刷新
 	if err := bm.LoadHeaderData(); err != nil {
+		//块能读出来但无法解码时(例如缺少密钥)不能重置文件,否则会丢失所有数据
+		if errors.Is(err, ErrTransformFailed) {
+			bm.File.Close()
+			return nil, err
+		}
 		log.Warnf("读取文件header block失败 warn = %v", err)
-		if err := bm.Expansion(blocks); err != nil {
-			panic(err)
+		if err := bm.reset(blocks); err != nil {
+			bm.File.Close()
+			return nil, err
 		}
+	}
+	return bm, nil
+}
 
-		bm.md.UsagedBlockNum = 1
-		bm.UsagedBlock.Header = BlockHeader{
-			UsedSize: 0,
-			BlockNum: 1,
-		}
-		bm.dirty = true
-		if err := bm.WriteBlock(); err != nil {
-			panic(err)
-		}
-		if err := bm.StoreHeaderData(); err != nil {
-			panic(err)
-		}
+// reset把文件重置为只有一个空块的状态
+func (bm *BlockManager) reset(blocks int) error {
+	if err := bm.Expansion(blocks); err != nil {
+		return err
 	}
-	return bm
+	bm.md.UsagedBlockNum = 1
+	bm.UsagedBlock.Header = BlockHeader{
+		UsedSize: 0,
+		BlockNum: 1,
+	}
+	bm.plain = bm.plain[:0]
+	bm.dirty = true
+	if err := bm.WriteBlock(); err != nil {
+		return err
+	}
+	return bm.StoreHeaderData()
 }
@@ -78,17 +78,3 @@ func (b *Block) CheckSum() bool {
 
 	return true
 }
-
-func (b *Block) GetEntries() [][]byte {
-	p := 0
-	res := make([][]byte, b.Header.EntryNums)
-	for i := range b.Header.EntryNums {
-		entrySize := int16(binary.LittleEndian.Uint16(b.EntriesData[p : p+2]))
-		p += 2
-		res[i] = make([]byte, entrySize)
-		copy(res[i], b.EntriesData[p:p+int(entrySize)])
-		p += int(entrySize)
-
-	}
-	return res
-}
@@ -10,4 +10,9 @@ package persister
 		因为一个block最多有4096字节,所以size虽有16bit但是用不完所有bit
 
 	4.WHY NOT golang.org/x/exp/mmap
+
+	块的transform:
+	每个块header中的Transform字段记录了该块body的编码方式(压缩算法与是否加密),为0时与最初的格式完全一致
+	开启压缩后一个块可以容纳更多的原始数据,只要压缩后的结果能放入一个block即可
+	读取时只按照块自身记录的transform解码,因此修改压缩配置后老文件依然可读,但读取加密块必须提供密钥
 */
@@ -6,6 +6,7 @@ import (
 	"io"
 
 	"github.com/hkensame/goken/pkg/errors"
+	"github.com/hkensame/goken/pkg/log"
 )
 
 // Header Block的存储默认是立马刷新而不使用缓存
@@ -48,7 +49,17 @@ func (bm *BlockManager) LoadHeaderData() error {
 		return err
 	}
 
-	bm.UsagedBlock.Unmarshal(data)
+	uerr := bm.UsagedBlock.Unmarshal(data)
+	plain, err := bm.decode(bm.UsagedBlock)
+	if err != nil {
+		//块本身已经损坏时解码失败是预期内的,与之前一样直接在该块上继续写入
+		if uerr == nil {
+			return err
+		}
+		log.Warnf("[persister] 正在使用的block已损坏 warn = %v", uerr)
+		plain = nil
+	}
+	bm.plain = append(bm.plain[:0], plain...)
 	return nil
 }
 
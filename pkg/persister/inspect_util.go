@@ -0,0 +1,80 @@
+package persister
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// OpenBlockManager以只读方式打开一个已有的persister文件,只读取header block中的元数据
+// 与MustNewBlockManager不同,header损坏时会直接返回错误而不会重置文件,适合用于检查与修复
+// opts中需要提供读取加密块所需的密钥
+func OpenBlockManager(path string, opts ...OptionFunc) (*BlockManager, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	bm := &BlockManager{
+		File:        f,
+		md:          new(metadata),
+		UsagedBlock: &Block{},
+	}
+	for _, opt := range opts {
+		opt(bm)
+	}
+	if err := bm.seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	buf, err := bm.read(bm.File, HeaderBlockSize)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, bm.md); err != nil {
+		f.Close()
+		return nil, ErrUnmarshalFailed
+	}
+	return bm, nil
+}
+
+// header中记录的已分配块数
+func (bm *BlockManager) BlockNums() int {
+	return int(bm.md.BlockNums)
+}
+
+// header中记录的正在使用的块号
+func (bm *BlockManager) UsagedBlockNum() int {
+	return int(bm.md.UsagedBlockNum)
+}
+
+// FileBlocks返回文件中实际存在的完整数据块数量,不包括header block
+func (bm *BlockManager) FileBlocks() (int, error) {
+	info, err := bm.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	n := int(info.Size()/int64(BlockSize)) - 1
+	if n < 0 {
+		n = 0
+	}
+	return n, nil
+}
+
+// ReadBlockAt读取并解析指定块号的block
+// 如果只是checksum检查失败,仍会返回解析出的block以及ErrChecksumFailed,调用者可以自行决定是否使用其中的数据
+func (bm *BlockManager) ReadBlockAt(blocknum int) (*Block, error) {
+	data, err := bm.readBlock(blocknum)
+	if err != nil {
+		return nil, err
+	}
+	b := &Block{}
+	if err := b.Unmarshal(data); err != nil {
+		if err == ErrChecksumFailed {
+			return b, err
+		}
+		return nil, err
+	}
+	return b, nil
+}
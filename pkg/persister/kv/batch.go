@@ -0,0 +1,49 @@
+package kv
+
+import "bytes"
+
+// Batch内的所有操作会被原子地写入,重启回放时要么全部生效要么全部丢弃
+// Batch不是并发安全的
+type Batch struct {
+	records []record
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Put与Delete都会拷贝传入的key与value,调用之后可以随意复用原切片
+func (b *Batch) Put(key, value []byte) {
+	b.records = append(b.records, record{
+		op:    opPut,
+		key:   bytes.Clone(key),
+		value: bytes.Clone(value),
+	})
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.records = append(b.records, record{
+		op:  opDelete,
+		key: bytes.Clone(key),
+	})
+}
+
+func (b *Batch) Len() int {
+	return len(b.records)
+}
+
+func (b *Batch) Reset() {
+	b.records = b.records[:0]
+}
+
+func (b *Batch) validate(limit int) error {
+	for i := range b.records {
+		if len(b.records[i].key) == 0 {
+			return ErrEmptyKey
+		}
+		if b.records[i].size() > limit {
+			return ErrRecordTooLarge
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package kv
+
+import (
+	"os"
+
+	"github.com/hkensame/goken/pkg/log"
+)
+
+func (db *DB) needCompact() bool {
+	if db.compactRatio <= 0 || db.written < db.compactMinSize {
+		return false
+	}
+	return float64(db.written) > float64(db.mt.size)*db.compactRatio
+}
+
+// Compact会把所有存活的数据重写到一个新文件中并替换掉旧文件,以回收被覆盖或删除的数据占用的空间
+func (db *DB) Compact() error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.compact()
+}
+
+func (db *DB) compact() error {
+	tmp := db.path + ".compact"
+	snap := &Snapshot{mt: db.mt}
+	if err := snap.Save(tmp, db.blocks, db.persisterOpts...); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// 先关闭旧文件再替换,失败时旧文件仍然完整
+	if err := db.bm.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, db.path); err != nil {
+		log.Errorf("[kv] compaction替换文件失败 err = %v", err)
+		os.Remove(tmp)
+	}
+
+	mt := db.mt
+	db.mt = newMemtable()
+	db.written = 0
+	if err := db.open(); err != nil {
+		db.closed = true
+		db.mt = mt
+		return err
+	}
+	return nil
+}
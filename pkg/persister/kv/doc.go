@@ -0,0 +1,14 @@
+package kv
+
+/*
+	kv是构建在persister块格式之上的嵌入式有序kv存储,适合在sidecar中保存offset、去重id、outbox等少量状态
+
+	文件格式:
+	1. persister的custom data中写入魔数goken-kv/1
+	2. 每个entry的第一个字节为flag,之后紧跟若干record,record = op(1B) + uvarint(keyLen) + key + uvarint(valueLen) + value
+	3. 一个batch可能跨越多个entry,除最后一个entry外flag均为entryContinued,回放时只有读到entryFinal才会应用整个batch
+	4. batch的第一个entry的flag会带上entryStart,回放时读到entryStart会丢弃之前未完成的batch
+
+	所有数据都会在内存中保留一份有序副本,因此不适合存储超过内存容量的数据
+	单条record必须能放进一个block,即key与value加起来不能超过大约4KB,开启加密或压缩时上限会相应减小
+*/
@@ -0,0 +1,254 @@
+package kv
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/hkensame/goken/pkg/errors"
+	"github.com/hkensame/goken/pkg/log"
+	"github.com/hkensame/goken/pkg/persister"
+)
+
+// 写在persister custom data中的魔数,用于识别该文件是否由kv创建
+var magic = []byte("goken-kv/1")
+
+var (
+	ErrEmptyKey        = errors.New("key不能为空")
+	ErrRecordTooLarge  = errors.New("单条key-value过大,无法放入一个block中")
+	ErrCorruptedRecord = errors.New("读出的record格式有误")
+	ErrNotKVFile       = errors.New("该文件不是由kv创建的persister文件")
+	ErrClosed          = errors.New("kv已经被关闭")
+)
+
+// DB是一个基于persister的嵌入式有序kv存储
+// 所有的写操作以追加的方式写入persister,内存中保存一份有序的全量数据,读操作不会访问磁盘
+// 文件中累积的过期数据通过Compact清理,DB是并发安全的
+type DB struct {
+	path string
+	bm   *persister.BlockManager
+	mt   *memtable
+	mtx  sync.RWMutex
+
+	// 单个entry最多能承载的record字节数,由bm的配置决定
+	maxPayload int
+	// 写入文件的record字节数,compaction之后会被重置为存活数据量
+	written int
+	closed  bool
+
+	blocks         int
+	sync           bool
+	compactRatio   float64
+	compactMinSize int
+	persisterOpts  []persister.OptionFunc
+}
+
+// IsKVFile判断persister文件中的custom data是否由kv写入
+func IsKVFile(custom []byte) bool {
+	return bytes.Equal(custom, magic)
+}
+
+func MustOpen(path string, opts ...OptionFunc) *DB {
+	db, err := Open(path, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// Open会打开或创建path对应的文件,并回放其中所有完整的batch
+func Open(path string, opts ...OptionFunc) (*DB, error) {
+	db := &DB{
+		path:           path,
+		mt:             newMemtable(),
+		blocks:         16,
+		sync:           true,
+		compactRatio:   0,
+		compactMinSize: 1 << 20,
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+
+	if err := db.open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *DB) open() error {
+	bm, err := persister.NewBlockManager(db.path, db.blocks, db.persisterOpts...)
+	if err != nil {
+		return err
+	}
+	db.bm = bm
+	db.maxPayload = maxPayload(db.bm)
+
+	custom, err := db.bm.GetCustomData()
+	if err != nil {
+		db.bm.Close()
+		return err
+	}
+	if len(custom) == 0 {
+		if err := db.bm.StoreCustomData(magic); err != nil {
+			db.bm.Close()
+			return err
+		}
+	} else if !IsKVFile(custom) {
+		db.bm.Close()
+		return ErrNotKVFile
+	}
+
+	if err := db.replay(); err != nil {
+		db.bm.Close()
+		return err
+	}
+	return nil
+}
+
+func (db *DB) replay() error {
+	var pending []record
+	br := db.bm.ReadBlockEntries()
+	for {
+		entries, err := br.Next()
+		if err != nil {
+			return errors.Wrap(err, "回放kv文件失败")
+		}
+		if entries == nil {
+			break
+		}
+		for _, e := range entries {
+			flag, records, err := decodeEntry(e)
+			if err != nil {
+				return err
+			}
+			db.written += len(e) - 1
+			if flag&entryStart != 0 {
+				// 新的batch开始时之前还有未完成的batch,说明那个batch写入时发生了中断
+				pending = nil
+			}
+			pending = append(pending, records...)
+			if flag&^entryStart == entryFinal {
+				db.mt.apply(pending)
+				pending = nil
+			}
+		}
+	}
+	// 任何没有以entryFinal结尾的batch都说明写入时发生了中断,均不会被应用
+	return nil
+}
+
+func (db *DB) Get(key []byte) ([]byte, bool) {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+	v, ok := db.mt.get(key)
+	if !ok {
+		return nil, false
+	}
+	return bytes.Clone(v), true
+}
+
+func (db *DB) Has(key []byte) bool {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+	_, ok := db.mt.get(key)
+	return ok
+}
+
+func (db *DB) Len() int {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+	return len(db.mt.items)
+}
+
+func (db *DB) Put(key, value []byte) error {
+	b := NewBatch()
+	b.Put(key, value)
+	return db.Write(b)
+}
+
+func (db *DB) Delete(key []byte) error {
+	b := NewBatch()
+	b.Delete(key)
+	return db.Write(b)
+}
+
+// Write原子地写入一个batch,写入成功后b可以Reset后复用
+func (db *DB) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if err := b.validate(db.maxPayload); err != nil {
+		return err
+	}
+
+	// 写入失败时回滚已经写入的entry,避免半个batch留在当前块中被之后的写入一起落盘
+	pos := db.bm.Mark()
+	written := 0
+	for _, e := range encodeEntries(b.records, db.maxPayload) {
+		if err := db.bm.WriteEntry(e); err != nil {
+			return db.rollback(pos, err)
+		}
+		written += len(e) - 1
+	}
+	if db.sync {
+		if err := db.bm.Flush(); err != nil {
+			return db.rollback(pos, err)
+		}
+	}
+	db.written += written
+	db.mt.apply(b.records)
+	// batch中的切片已经被memtable引用,不能再被batch复用
+	b.records = nil
+
+	// batch已经写入并生效,compaction失败不能让调用者误以为写入失败而重试,留给之后的写入或Compact再次尝试
+	if db.needCompact() {
+		if err := db.compact(); err != nil {
+			log.Errorf("[kv] compaction失败 path = %s, err = %v", db.path, err)
+		}
+	}
+	return nil
+}
+
+func (db *DB) rollback(pos persister.Position, err error) error {
+	if rerr := db.bm.Rollback(pos); rerr != nil {
+		// 回滚后的块没能落盘时,残留的entry因为没有entryFinal在回放时也会被丢弃
+		log.Errorf("[kv] 回滚写入失败 path = %s, err = %v", db.path, rerr)
+	}
+	return err
+}
+
+// Range按key升序遍历[start,end)区间,start或end为nil表示不限制该侧边界
+// 遍历基于调用时的快照进行,fn中可以安全地调用DB的写方法,fn返回false时停止遍历
+func (db *DB) Range(start, end []byte, fn func(key, value []byte) bool) {
+	db.Snapshot().Range(start, end, fn)
+}
+
+// Prefix按key升序遍历所有以prefix开头的key
+func (db *DB) Prefix(prefix []byte, fn func(key, value []byte) bool) {
+	db.Snapshot().Prefix(prefix, fn)
+}
+
+// Flush把当前块中还未落盘的数据写入文件
+func (db *DB) Flush() error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.bm.Flush()
+}
+
+func (db *DB) Close() error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	return db.bm.Close()
+}
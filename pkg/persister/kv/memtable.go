@@ -0,0 +1,112 @@
+package kv
+
+import (
+	"bytes"
+	"sort"
+)
+
+// item一旦放入memtable就不会再被修改,更新key时会用新的item替换旧的
+// 这样snapshot只需要拷贝一份指针切片就能得到一个不会再变化的视图
+type item struct {
+	key   []byte
+	value []byte
+}
+
+// memtable是一个按key有序的切片,sidecar场景下的数据量不大,二分查找加切片搬移足够使用
+type memtable struct {
+	items []*item
+	// 所有存活的key与value的字节数之和,用于判断是否需要compaction
+	size int
+}
+
+func newMemtable() *memtable {
+	return &memtable{}
+}
+
+func (m *memtable) search(key []byte) (int, bool) {
+	i := sort.Search(len(m.items), func(i int) bool {
+		return bytes.Compare(m.items[i].key, key) >= 0
+	})
+	return i, i < len(m.items) && bytes.Equal(m.items[i].key, key)
+}
+
+func (m *memtable) get(key []byte) ([]byte, bool) {
+	i, ok := m.search(key)
+	if !ok {
+		return nil, false
+	}
+	return m.items[i].value, true
+}
+
+// key与value会被直接引用,调用者需要保证之后不再修改它们
+func (m *memtable) put(key, value []byte) {
+	it := &item{key: key, value: value}
+	i, ok := m.search(key)
+	if ok {
+		m.size += len(value) - len(m.items[i].value)
+		m.items[i] = it
+		return
+	}
+	m.items = append(m.items, nil)
+	copy(m.items[i+1:], m.items[i:])
+	m.items[i] = it
+	m.size += len(key) + len(value)
+}
+
+func (m *memtable) delete(key []byte) bool {
+	i, ok := m.search(key)
+	if !ok {
+		return false
+	}
+	m.size -= len(m.items[i].key) + len(m.items[i].value)
+	copy(m.items[i:], m.items[i+1:])
+	m.items[len(m.items)-1] = nil
+	m.items = m.items[:len(m.items)-1]
+	return true
+}
+
+func (m *memtable) apply(records []record) {
+	for i := range records {
+		switch records[i].op {
+		case opPut:
+			m.put(records[i].key, records[i].value)
+		case opDelete:
+			m.delete(records[i].key)
+		}
+	}
+}
+
+func (m *memtable) clone() *memtable {
+	items := make([]*item, len(m.items))
+	copy(items, m.items)
+	return &memtable{items: items, size: m.size}
+}
+
+// ascend按key升序遍历[start,end)区间内的所有item,start或end为nil表示不限制该侧边界,fn返回false时停止遍历
+func (m *memtable) ascend(start, end []byte, fn func(key, value []byte) bool) {
+	i := 0
+	if start != nil {
+		i, _ = m.search(start)
+	}
+	for ; i < len(m.items); i++ {
+		it := m.items[i]
+		if end != nil && bytes.Compare(it.key, end) >= 0 {
+			return
+		}
+		if !fn(it.key, it.value) {
+			return
+		}
+	}
+}
+
+// prefixEnd返回所有以prefix开头的key的上界(不包含),如果prefix全部由0xff组成则返回nil表示没有上界
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package kv
+
+import "github.com/hkensame/goken/pkg/persister"
+
+type OptionFunc func(*DB)
+
+// 创建文件时初始分配的块数
+func WithBlocks(blocks int) OptionFunc {
+	return func(db *DB) {
+		db.blocks = blocks
+	}
+}
+
+// 为true时每次写入后都会立即把当前块落盘,为false时只有在块写满、Flush或Close时才会落盘
+func WithSync(sync bool) OptionFunc {
+	return func(db *DB) {
+		db.sync = sync
+	}
+}
+
+// 当文件中的数据量超过存活数据量的ratio倍时自动进行compaction,为0表示不自动compaction
+func WithCompactRatio(ratio float64) OptionFunc {
+	return func(db *DB) {
+		db.compactRatio = ratio
+	}
+}
+
+// 自动compaction的最小文件数据量,避免数据很少时频繁重写文件
+func WithCompactMinSize(size int) OptionFunc {
+	return func(db *DB) {
+		db.compactMinSize = size
+	}
+}
+
+// 传递给底层persister的配置,例如压缩与加密
+func WithPersisterOptions(opts ...persister.OptionFunc) OptionFunc {
+	return func(db *DB) {
+		db.persisterOpts = append(db.persisterOpts, opts...)
+	}
+}
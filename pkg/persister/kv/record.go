@@ -0,0 +1,115 @@
+package kv
+
+import (
+	"encoding/binary"
+
+	"github.com/hkensame/goken/pkg/persister"
+)
+
+const (
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+// 每个entry的第一个字节用于标记该entry是否为一个batch的最后一段
+// 一个batch可能会被拆成多个entry写入,只有读到entryFinal时才会把之前累积的record一起应用
+// batch的第一个entry会额外带上entryStart,回放时据此丢弃之前被中断的batch
+const (
+	entryFinal     byte = 0
+	entryContinued byte = 1
+	entryStart     byte = 2
+)
+
+// maxPayload返回一个entry中除flag外最多能承载的record字节数,取决于bm的压缩与加密配置
+func maxPayload(bm *persister.BlockManager) int {
+	return bm.MaxEntrySize() - 1
+}
+
+type record struct {
+	op    byte
+	key   []byte
+	value []byte
+}
+
+func uvarintLen(n int) int {
+	l := 1
+	for n >= 0x80 {
+		n >>= 7
+		l++
+	}
+	return l
+}
+
+func (r *record) size() int {
+	return 1 + uvarintLen(len(r.key)) + len(r.key) + uvarintLen(len(r.value)) + len(r.value)
+}
+
+func (r *record) appendTo(buf []byte) []byte {
+	buf = append(buf, r.op)
+	buf = binary.AppendUvarint(buf, uint64(len(r.key)))
+	buf = append(buf, r.key...)
+	buf = binary.AppendUvarint(buf, uint64(len(r.value)))
+	buf = append(buf, r.value...)
+	return buf
+}
+
+func readBytes(data []byte) ([]byte, []byte, error) {
+	l, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < l {
+		return nil, nil, ErrCorruptedRecord
+	}
+	data = data[n:]
+	return data[:l:l], data[l:], nil
+}
+
+// decodeEntry会解析一个entry,返回该entry的flag以及其中包含的所有record
+func decodeEntry(data []byte) (byte, []record, error) {
+	if len(data) == 0 {
+		return 0, nil, ErrCorruptedRecord
+	}
+	flag := data[0]
+	if f := flag &^ entryStart; f != entryFinal && f != entryContinued {
+		return 0, nil, ErrCorruptedRecord
+	}
+	data = data[1:]
+
+	var (
+		res []record
+		err error
+	)
+	for len(data) > 0 {
+		r := record{op: data[0]}
+		if r.op != opPut && r.op != opDelete {
+			return 0, nil, ErrCorruptedRecord
+		}
+		if r.key, data, err = readBytes(data[1:]); err != nil {
+			return 0, nil, err
+		}
+		if r.value, data, err = readBytes(data); err != nil {
+			return 0, nil, err
+		}
+		res = append(res, r)
+	}
+	return flag, res, nil
+}
+
+// encodeEntries会把records尽量紧凑地打包成若干个entry,除最后一个外其余entry都被标记为entryContinued,
+// 第一个entry额外带上entryStart
+// 调用者需要保证每个record的大小都不超过limit
+func encodeEntries(records []record, limit int) [][]byte {
+	var (
+		res [][]byte
+		buf = []byte{entryContinued}
+	)
+	for i := range records {
+		if len(buf)-1+records[i].size() > limit {
+			res = append(res, buf)
+			buf = []byte{entryContinued}
+		}
+		buf = records[i].appendTo(buf)
+	}
+	buf[0] = entryFinal
+	res = append(res, buf)
+	res[0][0] |= entryStart
+	return res
+}
@@ -0,0 +1,78 @@
+package kv
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/hkensame/goken/pkg/persister"
+)
+
+// Snapshot是DB在某一时刻的只读视图,之后对DB的写入不会影响已经取得的Snapshot
+type Snapshot struct {
+	mt *memtable
+}
+
+func (db *DB) Snapshot() *Snapshot {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+	return &Snapshot{mt: db.mt.clone()}
+}
+
+func (s *Snapshot) Get(key []byte) ([]byte, bool) {
+	v, ok := s.mt.get(key)
+	if !ok {
+		return nil, false
+	}
+	return bytes.Clone(v), true
+}
+
+func (s *Snapshot) Len() int {
+	return len(s.mt.items)
+}
+
+// 传给fn的key与value不允许被修改,如果需要在fn之外持有请自行拷贝
+func (s *Snapshot) Range(start, end []byte, fn func(key, value []byte) bool) {
+	s.mt.ascend(start, end, fn)
+}
+
+func (s *Snapshot) Prefix(prefix []byte, fn func(key, value []byte) bool) {
+	s.mt.ascend(prefix, prefixEnd(prefix), fn)
+}
+
+// Save把快照中的数据写入到path对应的新文件中,如果文件已存在会被覆盖
+// 写出的文件只包含存活的数据,可以直接用Open打开,opts用于指定写出文件的压缩与加密方式
+func (s *Snapshot) Save(path string, blocks int, opts ...persister.OptionFunc) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	bm, err := persister.NewBlockManager(path, blocks, opts...)
+	if err != nil {
+		return err
+	}
+	if err := bm.StoreCustomData(magic); err != nil {
+		bm.Close()
+		return err
+	}
+
+	records := make([]record, 0, len(s.mt.items))
+	for _, it := range s.mt.items {
+		records = append(records, record{op: opPut, key: it.key, value: it.value})
+	}
+	// 快照中的每条数据都是独立的,因此每个entry都可以同时标记为entryStart与entryFinal
+	limit := maxPayload(bm)
+	for i := range records {
+		//写出文件的配置可能与源文件不同,单条record未必还能放进一个entry
+		if records[i].size() > limit {
+			bm.Close()
+			return ErrRecordTooLarge
+		}
+	}
+	for _, e := range encodeEntries(records, limit) {
+		e[0] = entryStart | entryFinal
+		if err := bm.WriteEntry(e); err != nil {
+			bm.Close()
+			return err
+		}
+	}
+	return bm.Close()
+}
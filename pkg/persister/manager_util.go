@@ -2,6 +2,7 @@ package persister
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 
 	"github.com/hkensame/goken/pkg/log"
@@ -71,6 +72,7 @@ func (bm *BlockManager) seekBlock(blocknum int) error {
 }
 
 // 这两个函数只负责UsedBlock
+// 落盘前会先把plain中的数据按照配置的transform编码到UsagedBlock的body中
 func (bm *BlockManager) WriteBlock() error {
 	if !bm.dirty {
 		return nil
@@ -78,6 +80,16 @@ func (bm *BlockManager) WriteBlock() error {
 	if err := bm.SeekBlock(); err != nil {
 		return err
 	}
+	body, err := bm.encode(bm.plain, bm.UsagedBlock.Header.BlockNum)
+	if err != nil || len(body) > BodySize {
+		log.Errorf("[persister] block数据编码失败 err = %v", err)
+		return ErrPersistFailed
+	}
+	bm.UsagedBlock.EntriesData = [BodySize]byte{}
+	copy(bm.UsagedBlock.EntriesData[:], body)
+	bm.UsagedBlock.Header.UsedSize = int16(len(body))
+	bm.UsagedBlock.Header.Transform = bm.transform()
+
 	writer := bufio.NewWriterSize(bm.File, BlockSize)
 	defer writer.Flush()
 	bm.UsagedBlock.SetCheckSum()
@@ -136,55 +148,108 @@ func (br *blockReader) Next() ([][]byte, error) {
 	if err := block.Unmarshal(b); err != nil {
 		return nil, err
 	}
-	res := block.GetEntries()
+	res, err := br.bm.BlockEntries(block)
+	if err != nil {
+		return nil, err
+	}
 	br.now++
 	return res, nil
 }
 
 // 判断现在使用的Block是否还够用,不够用就换新的Block
 // 这样可能会造成每个block都有可能会有几个到几百个字节未使用,但保证了每个条目都落在一个块下
+// 开启压缩时只能按最坏情况估计,WriteEntry会使用更精确的判断
 func (bm *BlockManager) CheckStatus(needSize int) error {
-	//如果容量已经不足则先落盘数据
-	if bm.UsagedBlock.RemainedSize()-needSize < 0 {
-		if err := bm.WriteBlock(); err != nil {
-			return err
-		}
-		bm.md.UsagedBlockNum++
-		//需要扩充文件
-		if bm.md.UsagedBlockNum > bm.md.BlockNums {
-			bm.md.BlockNums *= 2
-			if err := bm.Expansion(int(bm.md.BlockNums)); err != nil {
-				return err
-			}
-		}
-		if err := bm.StoreHeaderData(); err != nil {
-			return err
-		}
-		if err := bm.SeekBlock(); err != nil {
+	n := len(bm.plain) + needSize
+	if n > bm.capacity() || bm.maxEncodedLen(n) > BodySize {
+		return bm.nextBlock()
+	}
+	return nil
+}
+
+// nextBlock会先落盘当前块的数据,再切换到一个新的空块
+func (bm *BlockManager) nextBlock() error {
+	if err := bm.WriteBlock(); err != nil {
+		return err
+	}
+	bm.md.UsagedBlockNum++
+	//需要扩充文件
+	if bm.md.UsagedBlockNum > bm.md.BlockNums {
+		bm.md.BlockNums *= 2
+		if err := bm.Expansion(int(bm.md.BlockNums)); err != nil {
 			return err
 		}
-		//清空数组
-		bm.UsagedBlock.EntriesData = [BodySize]byte{}
-		bm.UsagedBlock.Header.EntryNums = 0
-		bm.UsagedBlock.Header.BlockNum = int16(bm.md.UsagedBlockNum)
-		bm.UsagedBlock.Header.UsedSize = 0
-		bm.dirty = true
 	}
+	if err := bm.StoreHeaderData(); err != nil {
+		return err
+	}
+	if err := bm.SeekBlock(); err != nil {
+		return err
+	}
+	//清空数组
+	bm.plain = bm.plain[:0]
+	bm.UsagedBlock.EntriesData = [BodySize]byte{}
+	bm.UsagedBlock.Header.EntryNums = 0
+	bm.UsagedBlock.Header.BlockNum = int16(bm.md.UsagedBlockNum)
+	bm.UsagedBlock.Header.UsedSize = 0
+	bm.dirty = true
 	return nil
 }
 
 func (bm *BlockManager) WriteEntry(d []byte) error {
 	be := newBlockEntry(d)
-	if err := bm.CheckStatus(int(be.EntrySize + 2)); err != nil {
-		return err
+	data := be.encode()
+	if !bm.fits(data) {
+		//一个空块都放不下的entry直接拒绝,避免不断地分配新块
+		if len(bm.plain) == 0 {
+			return ErrEntryTooLarge
+		}
+		if err := bm.nextBlock(); err != nil {
+			return err
+		}
+		if !bm.fits(data) {
+			return ErrEntryTooLarge
+		}
 	}
 	bm.dirty = true
 	bm.UsagedBlock.Header.EntryNums++
-	copy(bm.UsagedBlock.EntriesData[bm.UsagedBlock.Header.UsedSize:], be.encode())
-	bm.UsagedBlock.Header.UsedSize += be.EntrySize + 2
+	bm.plain = append(bm.plain, data...)
 	return nil
 }
 
+// Position是某一时刻的写入位置,用于在一组entry只写入了一部分时回滚
+type Position struct {
+	usaged    int32
+	entryNums int16
+	plain     []byte
+}
+
+// Mark返回当前的写入位置
+func (bm *BlockManager) Mark() Position {
+	return Position{
+		usaged:    bm.md.UsagedBlockNum,
+		entryNums: bm.UsagedBlock.Header.EntryNums,
+		plain:     bytes.Clone(bm.plain),
+	}
+}
+
+// Rollback丢弃p之后写入的所有entry,其间切换过的新块会在之后的写入中被覆盖,
+// 内存中的状态总会被恢复,返回的error只表示回滚后的块没能落盘
+func (bm *BlockManager) Rollback(p Position) error {
+	switched := p.usaged != bm.md.UsagedBlockNum
+	bm.md.UsagedBlockNum = p.usaged
+	bm.plain = append(bm.plain[:0], p.plain...)
+	bm.UsagedBlock.Header.BlockNum = int16(p.usaged)
+	bm.UsagedBlock.Header.EntryNums = p.entryNums
+	bm.dirty = true
+	if switched {
+		if err := bm.StoreHeaderData(); err != nil {
+			return err
+		}
+	}
+	return bm.WriteBlock()
+}
+
 // 要求必须写成功到磁盘中
 func (bm *BlockManager) MustWriteEntry(d []byte) error {
 	if err := bm.WriteEntry(d); err != nil {
@@ -192,3 +257,14 @@ func (bm *BlockManager) MustWriteEntry(d []byte) error {
 	}
 	return bm.Flush()
 }
+
+// Close会先把UsagedBlock落盘再关闭文件,关闭后bm不可再使用
+func (bm *BlockManager) Close() error {
+	if err := bm.Flush(); err != nil {
+		return err
+	}
+	if err := bm.sync(); err != nil {
+		return err
+	}
+	return bm.File.Close()
+}
@@ -0,0 +1,10 @@
+package segment
+
+/*
+	segment把一个追加日志拆分为多个persister文件,适合日志型的写入场景
+
+	1. 每个segment文件以其第一条entry的offset命名,例如00000000000000000000.seg,目录下所有segment文件按名称排序即构成segment的索引
+	2. 每个segment的custom data中保存魔数goken-seg/1、起始offset以及创建时间
+	3. 当前segment使用的块数达到上限后会被封存,后续写入进入新的segment,封存的segment不会再被修改
+	4. 每次滚动segment时按照保留策略(segment数量、封存时间、总大小)从最老的segment开始删除,活跃segment永远不会被删除
+*/
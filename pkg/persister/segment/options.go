@@ -0,0 +1,67 @@
+package segment
+
+import (
+	"time"
+
+	"github.com/hkensame/goken/pkg/persister"
+)
+
+type OptionFunc func(*Log)
+
+// 每个segment创建时初始分配的块数
+func WithBlocks(blocks int) OptionFunc {
+	return func(l *Log) {
+		l.blocks = blocks
+	}
+}
+
+// 每个segment最多使用n个数据块,当前segment写满n个块后滚动到新的segment
+func WithMaxSegmentBlocks(n int) OptionFunc {
+	return func(l *Log) {
+		l.maxBlocks = n
+	}
+}
+
+// 当前segment已使用的大小(包括header block)达到size字节时滚动到新的segment,会被向上取整为整数个block,
+// segment文件预分配但未使用的块不计入大小
+func WithMaxSegmentBytes(size int64) OptionFunc {
+	return func(l *Log) {
+		l.maxBlocks = int((size+int64(persister.BlockSize)-1)/int64(persister.BlockSize)) - 1
+	}
+}
+
+// 最多保留n个segment,为0表示不限制
+func WithRetentionSegments(n int) OptionFunc {
+	return func(l *Log) {
+		l.retentionSegments = n
+	}
+}
+
+// 删除封存时间早于d的segment,为0表示不限制
+func WithRetentionAge(d time.Duration) OptionFunc {
+	return func(l *Log) {
+		l.retentionAge = d
+	}
+}
+
+// 所有segment已使用的总大小超过size字节时从最老的segment开始删除,为0表示不限制,
+// 与WithMaxSegmentBytes相同,预分配但未使用的块不计入大小
+func WithRetentionBytes(size int64) OptionFunc {
+	return func(l *Log) {
+		l.retentionBytes = size
+	}
+}
+
+// 为true时每次Append后都会立即把当前块落盘,此时同进程中的Reader可以立即读到新数据
+func WithSync(sync bool) OptionFunc {
+	return func(l *Log) {
+		l.sync = sync
+	}
+}
+
+// 传递给每个segment的persister配置,例如压缩与加密
+func WithPersisterOptions(opts ...persister.OptionFunc) OptionFunc {
+	return func(l *Log) {
+		l.persisterOpts = append(l.persisterOpts, opts...)
+	}
+}
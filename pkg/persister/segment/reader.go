@@ -0,0 +1,215 @@
+package segment
+
+import (
+	"io"
+
+	"github.com/hkensame/goken/pkg/errors"
+	"github.com/hkensame/goken/pkg/persister"
+)
+
+// Reader从某个offset开始按顺序读取Log中的entry,可以跨越多个segment
+// 重启后只需要保存Offset()的返回值,再用NewReader从该位置继续读取即可
+// Reader不是并发安全的,但多个Reader可以同时读取同一个Log
+type Reader struct {
+	l *Log
+
+	// 当前打开的segment
+	seg *SegmentInfo
+	bm  *persister.BlockManager
+
+	blockNum int
+	entries  [][]byte
+	idx      int
+	// 下一条将要读取的entry的offset
+	offset uint64
+}
+
+// NewReader创建一个从offset开始读取的Reader,offset可以等于NextOffset,此时Reader会等待新数据写入
+func (l *Log) NewReader(offset uint64) (*Reader, error) {
+	r := &Reader{l: l, offset: offset}
+	if err := r.seek(offset); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (l *Log) findSegment(offset uint64) (*SegmentInfo, bool) {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	for i, si := range l.segments {
+		last := i == len(l.segments)-1
+		if offset >= si.Base && (offset < si.End || (last && offset == si.End)) {
+			cp := *si
+			return &cp, last
+		}
+	}
+	return nil, false
+}
+
+// segmentEnd返回segment当前的结束offset以及它是否为活跃segment,活跃segment的结束offset会随写入增长
+func (l *Log) segmentEnd(base uint64) (uint64, bool) {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	for i, si := range l.segments {
+		if si.Base == base {
+			return si.End, i == len(l.segments)-1
+		}
+	}
+	// segment已经被保留策略删除,它的结束offset就是之后第一个segment的Base
+	for _, si := range l.segments {
+		if si.Base > base {
+			return si.Base, false
+		}
+	}
+	return 0, false
+}
+
+func (r *Reader) open(si *SegmentInfo) error {
+	if r.bm != nil {
+		r.bm.File.Close()
+		r.bm = nil
+	}
+	bm, err := persister.OpenBlockManager(si.Path, r.l.persisterOpts...)
+	if err != nil {
+		return errors.Wrapf(err, "打开segment %s 失败", si.Path)
+	}
+	r.seg = si
+	r.bm = bm
+	r.blockNum = 1
+	r.idx = 0
+	r.entries, err = r.readBlock(1)
+	return err
+}
+
+// readBlock读取指定块中的所有entry
+// 活跃segment中还未落盘的块会读取失败,此时视为空块返回
+func (r *Reader) readBlock(blocknum int) ([][]byte, error) {
+	// 先检查文件大小,避免读取不存在的块时persister打印错误日志
+	if n, err := r.bm.FileBlocks(); err == nil && blocknum > n {
+		return nil, nil
+	}
+	b, err := r.bm.ReadBlockAt(blocknum)
+	if err != nil {
+		if _, active := r.l.segmentEnd(r.seg.Base); active {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "读取segment %s 的block %d 失败", r.seg.Path, blocknum)
+	}
+	entries, err := r.bm.BlockEntries(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "解析segment %s 的block %d 失败", r.seg.Path, blocknum)
+	}
+	return entries, nil
+}
+
+// advance尝试读取新数据,当前块有新追加的entry时留在当前块,否则在下一个块不为空时切换到下一个块
+// 只有确实读到了新entry时才返回true,因此不会因为数据尚未落盘而跳过当前块中的entry
+func (r *Reader) advance() (bool, error) {
+	entries, err := r.readBlock(r.blockNum)
+	if err != nil {
+		return false, err
+	}
+	if len(entries) > len(r.entries) {
+		r.entries = entries
+		return true, nil
+	}
+	next, err := r.readBlock(r.blockNum + 1)
+	if err != nil {
+		return false, err
+	}
+	if len(next) == 0 {
+		return false, nil
+	}
+	r.blockNum++
+	r.entries = next
+	r.idx = 0
+	return true, nil
+}
+
+func (r *Reader) seek(offset uint64) error {
+	si, _ := r.l.findSegment(offset)
+	if si == nil {
+		return ErrOffsetOutOfRange
+	}
+	if err := r.open(si); err != nil {
+		return err
+	}
+
+	skip := offset - si.Base
+	for {
+		if skip < uint64(len(r.entries)) {
+			r.idx = int(skip)
+			return nil
+		}
+		next, err := r.readBlock(r.blockNum + 1)
+		if err != nil {
+			return err
+		}
+		if len(next) == 0 {
+			// offset正好是已落盘数据的末尾,停在当前块等待新数据
+			if skip == uint64(len(r.entries)) {
+				r.idx = len(r.entries)
+				return nil
+			}
+			return ErrOffsetOutOfRange
+		}
+		skip -= uint64(len(r.entries))
+		r.blockNum++
+		r.entries = next
+	}
+}
+
+// Next返回下一条entry及其offset,没有更多数据时返回io.EOF,之后有新数据写入时可以继续调用Next
+func (r *Reader) Next() (uint64, []byte, error) {
+	for {
+		end, active := r.l.segmentEnd(r.seg.Base)
+		if r.offset >= end {
+			if active {
+				return 0, nil, io.EOF
+			}
+			// 当前segment已经读完,切换到下一个segment
+			si, _ := r.l.findSegment(r.offset)
+			if si == nil {
+				return 0, nil, ErrOffsetOutOfRange
+			}
+			if err := r.open(si); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		if r.idx < len(r.entries) {
+			data := r.entries[r.idx]
+			r.idx++
+			offset := r.offset
+			r.offset++
+			return offset, data, nil
+		}
+
+		ok, err := r.advance()
+		if err != nil {
+			return 0, nil, err
+		}
+		if !ok {
+			if active {
+				// 数据已经写入但还未落盘
+				return 0, nil, io.EOF
+			}
+			return 0, nil, errors.Wrapf(ErrBadSegment, "segment %s 中缺少offset %d 的数据", r.seg.Path, r.offset)
+		}
+	}
+}
+
+// 下一条将要读取的entry的offset
+func (r *Reader) Offset() uint64 {
+	return r.offset
+}
+
+func (r *Reader) Close() error {
+	if r.bm == nil {
+		return nil
+	}
+	err := r.bm.File.Close()
+	r.bm = nil
+	return err
+}
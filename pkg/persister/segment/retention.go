@@ -0,0 +1,60 @@
+package segment
+
+import (
+	"os"
+	"time"
+
+	"github.com/hkensame/goken/pkg/log"
+)
+
+// ApplyRetention按照保留策略删除过期的segment,活跃segment永远不会被删除
+// 每次滚动segment时都会自动调用,若使用了WithRetentionAge且写入不频繁,可以定期手动调用
+func (l *Log) ApplyRetention() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.applyRetention()
+}
+
+func (l *Log) applyRetention() error {
+	sealed := len(l.segments) - 1
+	drop := 0
+
+	if l.retentionSegments > 0 && len(l.segments) > l.retentionSegments {
+		drop = len(l.segments) - l.retentionSegments
+	}
+
+	if l.retentionAge > 0 {
+		deadline := time.Now().Add(-l.retentionAge)
+		for i := drop; i < sealed && l.segments[i].Sealed.Before(deadline); i++ {
+			drop = i + 1
+		}
+	}
+
+	if l.retentionBytes > 0 {
+		var total int64
+		for _, si := range l.segments[drop:] {
+			total += si.Size
+		}
+		for i := drop; i < sealed && total > l.retentionBytes; i++ {
+			total -= l.segments[i].Size
+			drop = i + 1
+		}
+	}
+
+	if drop > sealed {
+		drop = sealed
+	}
+	for i := 0; i < drop; i++ {
+		// 已经打开了该segment的Reader仍然可以读完它,文件描述符关闭后空间才会被回收
+		if err := os.Remove(l.segments[i].Path); err != nil && !os.IsNotExist(err) {
+			l.segments = l.segments[i:]
+			return err
+		}
+		log.Infof("[segment] 根据保留策略删除segment %s", l.segments[i].Path)
+	}
+	l.segments = l.segments[drop:]
+	return nil
+}
@@ -0,0 +1,342 @@
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hkensame/goken/pkg/errors"
+	"github.com/hkensame/goken/pkg/log"
+	"github.com/hkensame/goken/pkg/persister"
+)
+
+const segmentExt = ".seg"
+
+var magic = []byte("goken-seg/1")
+
+var (
+	ErrOffsetOutOfRange = errors.New("给定的offset不在现存的segment范围内")
+	ErrBadSegment       = errors.New("segment文件的元数据有误")
+	ErrClosed           = errors.New("segment log已经被关闭")
+)
+
+// SegmentInfo描述了一个segment文件,segment内entry的offset范围为[Base,End)
+type SegmentInfo struct {
+	Path string
+	Base uint64
+	End  uint64
+	// segment被创建的时间
+	Created time.Time
+	// segment被封存(不再写入)的时间,活跃segment该值为零值
+	Sealed time.Time
+	// segment已使用的字节数,包括header block,不包括预分配但未使用的块
+	Size int64
+}
+
+// Log是由多个persister文件组成的追加日志,写满的segment会被封存并按照保留策略删除
+// 每条entry都有一个全局单调递增的offset,Reader可以从任意一个仍然存在的offset开始读取
+// Log是并发安全的
+type Log struct {
+	dir string
+	mtx sync.RWMutex
+
+	// 按Base升序排列,最后一个为活跃segment
+	segments []*SegmentInfo
+	active   *persister.BlockManager
+	closed   bool
+
+	blocks            int
+	maxBlocks         int
+	sync              bool
+	retentionSegments int
+	retentionAge      time.Duration
+	retentionBytes    int64
+	persisterOpts     []persister.OptionFunc
+}
+
+func MustOpen(dir string, opts ...OptionFunc) *Log {
+	l, err := Open(dir, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// Open会打开dir下已有的所有segment,如果没有则创建第一个segment
+func Open(dir string, opts ...OptionFunc) (*Log, error) {
+	l := &Log{
+		dir:       dir,
+		blocks:    64,
+		maxBlocks: 1024,
+		sync:      true,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.maxBlocks <= 0 {
+		l.maxBlocks = 1
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func segmentPath(dir string, base uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", base, segmentExt))
+}
+
+func encodeMeta(base uint64, created time.Time) []byte {
+	buf := make([]byte, 0, len(magic)+16)
+	buf = append(buf, magic...)
+	buf = binary.LittleEndian.AppendUint64(buf, base)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(created.UnixNano()))
+	return buf
+}
+
+func decodeMeta(data []byte) (uint64, time.Time, error) {
+	if len(data) != len(magic)+16 || string(data[:len(magic)]) != string(magic) {
+		return 0, time.Time{}, ErrBadSegment
+	}
+	data = data[len(magic):]
+	base := binary.LittleEndian.Uint64(data[:8])
+	created := time.Unix(0, int64(binary.LittleEndian.Uint64(data[8:])))
+	return base, created, nil
+}
+
+func usedBytes(bm *persister.BlockManager) int64 {
+	return int64(bm.UsagedBlockNum()+1) * int64(persister.BlockSize)
+}
+
+// countEntries统计一个segment中已经写入的entry数量
+func countEntries(bm *persister.BlockManager) (uint64, error) {
+	var n uint64
+	for i := 1; i <= bm.UsagedBlockNum(); i++ {
+		b, err := bm.ReadBlockAt(i)
+		if err != nil {
+			return 0, errors.Wrapf(err, "读取block %d 失败", i)
+		}
+		n += uint64(b.Header.EntryNums)
+	}
+	return n, nil
+}
+
+func (l *Log) load() error {
+	files, err := os.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+	var bases []uint64
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+
+	if len(bases) == 0 {
+		return l.roll(0)
+	}
+
+	for i, base := range bases {
+		si := &SegmentInfo{Path: segmentPath(l.dir, base), Base: base}
+		if i != len(bases)-1 {
+			si.End = bases[i+1]
+		}
+		l.segments = append(l.segments, si)
+	}
+
+	// 活跃segment还需要统计entry数量得到下一个offset
+	last := l.segments[len(l.segments)-1]
+	l.active = persister.MustNewBlockManager(last.Path, l.blocks, l.persisterOpts...)
+	repair := false
+	if err := l.loadMeta(l.active, last); err != nil {
+		n, cerr := countEntries(l.active)
+		l.active.Close()
+		l.active = nil
+		if cerr != nil || n > 0 {
+			return err
+		}
+		// roll在写入元数据之前中断会留下一个没有元数据的空segment,稍后以相同的base重新创建
+		log.Warnf("[segment] segment %s 缺少元数据且没有数据,将被重新创建", last.Path)
+		l.segments = l.segments[:len(l.segments)-1]
+		repair = true
+	} else {
+		n, err := countEntries(l.active)
+		if err != nil {
+			l.active.Close()
+			return err
+		}
+		last.End = last.Base + n
+	}
+
+	// 封存的segment只需要读取元数据
+	sealed := l.segments
+	if !repair {
+		sealed = sealed[:len(sealed)-1]
+	}
+	for _, si := range sealed {
+		bm, err := persister.OpenBlockManager(si.Path, l.persisterOpts...)
+		if err != nil {
+			return errors.Wrapf(err, "打开segment %s 失败", si.Path)
+		}
+		err = l.loadMeta(bm, si)
+		bm.File.Close()
+		if err != nil {
+			if l.active != nil {
+				l.active.Close()
+			}
+			return err
+		}
+	}
+	for i := 1; i < len(l.segments); i++ {
+		l.segments[i-1].Sealed = l.segments[i].Created
+	}
+
+	if repair {
+		if err := l.roll(last.Base); err != nil {
+			return err
+		}
+		if n := len(l.segments); n > 1 {
+			l.segments[n-2].Sealed = l.segments[n-1].Created
+		}
+	}
+	return nil
+}
+
+func (l *Log) loadMeta(bm *persister.BlockManager, si *SegmentInfo) error {
+	custom, err := bm.GetCustomData()
+	if err != nil {
+		return err
+	}
+	base, created, err := decodeMeta(custom)
+	if err != nil || base != si.Base {
+		return errors.Wrapf(ErrBadSegment, "segment %s", si.Path)
+	}
+	si.Created = created
+	si.Size = usedBytes(bm)
+	return nil
+}
+
+// roll封存当前活跃segment并以base为起始offset创建新的segment
+func (l *Log) roll(base uint64) error {
+	now := time.Now()
+	if l.active != nil {
+		if err := l.active.Close(); err != nil {
+			return err
+		}
+		l.segments[len(l.segments)-1].Sealed = now
+	}
+
+	si := &SegmentInfo{
+		Path:    segmentPath(l.dir, base),
+		Base:    base,
+		End:     base,
+		Created: now,
+	}
+	// 残留的同名文件一定是未写入任何数据的segment,直接覆盖
+	if err := os.Remove(si.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l.active = persister.MustNewBlockManager(si.Path, l.blocks, l.persisterOpts...)
+	if err := l.active.StoreCustomData(encodeMeta(base, now)); err != nil {
+		return err
+	}
+	si.Size = usedBytes(l.active)
+	l.segments = append(l.segments, si)
+	log.Infof("[segment] 滚动到新的segment %s", si.Path)
+
+	return l.applyRetention()
+}
+
+// Append追加一条entry并返回其offset
+func (l *Log) Append(data []byte) (uint64, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	// 当前segment的块已经用满且放不下这条entry时,先滚动到新的segment再写入
+	last := l.segments[len(l.segments)-1]
+	if l.active.UsagedBlockNum() >= l.maxBlocks && last.End > last.Base && !l.active.Fits(data) {
+		if err := l.roll(last.End); err != nil {
+			return 0, err
+		}
+		last = l.segments[len(l.segments)-1]
+	}
+	if err := l.active.WriteEntry(data); err != nil {
+		return 0, err
+	}
+	offset := last.End
+	last.End++
+	last.Size = usedBytes(l.active)
+
+	if l.sync {
+		if err := l.active.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// Flush把活跃segment中还未落盘的数据写入文件
+func (l *Log) Flush() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.active.Flush()
+}
+
+// 第一条仍然存在的entry的offset
+func (l *Log) FirstOffset() uint64 {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.segments[0].Base
+}
+
+// 下一条写入的entry将会获得的offset
+func (l *Log) NextOffset() uint64 {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.segments[len(l.segments)-1].End
+}
+
+// Segments返回当前所有segment的信息拷贝
+func (l *Log) Segments() []SegmentInfo {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	res := make([]SegmentInfo, len(l.segments))
+	for i, si := range l.segments {
+		res[i] = *si
+	}
+	return res
+}
+
+func (l *Log) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return l.active.Close()
+}
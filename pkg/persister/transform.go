@@ -0,0 +1,250 @@
+package persister
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/hkensame/goken/pkg/errors"
+	"github.com/klauspost/compress/zstd"
+)
+
+// transform记录在每个块的header中,低4位为压缩算法,TransformAESGCM位表示body经过了加密
+// 写入时先压缩再加密,读取时按照块自身记录的transform解码,因此修改配置后老的块依然可以读取
+const (
+	TransformNone   int16 = 0
+	TransformSnappy int16 = 1
+	TransformZstd   int16 = 2
+	TransformAESGCM int16 = 1 << 4
+
+	compressionMask int16 = 0x0f
+	knownTransforms       = compressionMask | TransformAESGCM
+)
+
+// 开启压缩后一个块中最多能容纳的原始数据量,实际能放入多少取决于压缩后能否放进一个block
+const maxPlainSize = 4 * BodySize
+
+var (
+	ErrTransformFailed  = errors.New("block数据解码失败")
+	ErrMissingKey       = errors.Wrap(ErrTransformFailed, "block经过了加密但没有提供密钥")
+	ErrUnknownTransform = errors.Wrap(ErrTransformFailed, "未知的block transform")
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		var err error
+		if zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1)); err != nil {
+			panic(err)
+		}
+		if zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1)); err != nil {
+			panic(err)
+		}
+	})
+}
+
+// 新写入的块使用的压缩算法,可选TransformNone,TransformSnappy,TransformZstd
+func WithCompression(compression int16) OptionFunc {
+	return func(bm *BlockManager) {
+		bm.compression = compression & compressionMask
+	}
+}
+
+// 使用AES-GCM加密块数据,key的长度必须为16,24或32字节,可以通过encrypt.DeriveKey由口令生成
+// 只要提供了密钥,即使新写入的块不再加密,老的加密块依然可以读取
+func WithEncryptionKey(key []byte) OptionFunc {
+	return func(bm *BlockManager) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			panic(err)
+		}
+		if bm.aead, err = cipher.NewGCM(block); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// transform返回新写入的块使用的transform
+func (bm *BlockManager) transform() int16 {
+	t := bm.compression
+	if bm.aead != nil {
+		t |= TransformAESGCM
+	}
+	return t
+}
+
+func (bm *BlockManager) overhead() int {
+	if bm.aead == nil {
+		return 0
+	}
+	return bm.aead.NonceSize() + bm.aead.Overhead()
+}
+
+// capacity返回当前配置下一个块最多能容纳的原始数据量
+func (bm *BlockManager) capacity() int {
+	if bm.compression != TransformNone {
+		return maxPlainSize
+	}
+	return BodySize - bm.overhead()
+}
+
+// MaxEntrySize返回当前配置下一定能写入一个空块的entry的最大长度,
+// 已经扣除了entry自身的长度字段与加密带来的开销,开启压缩时按数据完全不可压缩的最坏情况计算
+func (bm *BlockManager) MaxEntrySize() int {
+	lo, hi := 0, bm.capacity()
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if bm.maxEncodedLen(mid) <= BodySize {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo - 2
+}
+
+// maxEncodedLen返回压缩n个字节后可能的最大长度
+func (bm *BlockManager) maxEncodedLen(n int) int {
+	switch bm.compression {
+	case TransformSnappy:
+		return snappy.MaxEncodedLen(n) + bm.overhead()
+	case TransformZstd:
+		return n + n>>7 + 64 + bm.overhead()
+	}
+	return n + bm.overhead()
+}
+
+// Fits判断d作为一个entry能否直接追加到当前块中,为false时WriteEntry会切换到新的块
+func (bm *BlockManager) Fits(d []byte) bool {
+	return bm.fits(newBlockEntry(d).encode())
+}
+
+// fits判断在当前块中追加data后编码结果是否还能放进一个block
+// 只有在最坏情况下放不下时才会真正进行一次编码
+func (bm *BlockManager) fits(data []byte) bool {
+	n := len(bm.plain) + len(data)
+	if n > bm.capacity() {
+		return false
+	}
+	if bm.maxEncodedLen(n) <= BodySize {
+		return true
+	}
+	buf := make([]byte, 0, n)
+	buf = append(append(buf, bm.plain...), data...)
+	body, err := bm.encode(buf, bm.UsagedBlock.Header.BlockNum)
+	return err == nil && len(body) <= BodySize
+}
+
+// 使用块号作为附加数据,防止加密块被整体挪到其他位置
+func additionalData(blocknum int16) []byte {
+	return binary.LittleEndian.AppendUint16(nil, uint16(blocknum))
+}
+
+func (bm *BlockManager) encode(plain []byte, blocknum int16) ([]byte, error) {
+	data := plain
+	switch bm.compression {
+	case TransformSnappy:
+		data = snappy.Encode(nil, data)
+	case TransformZstd:
+		initZstd()
+		data = zstdEncoder.EncodeAll(data, nil)
+	}
+
+	if bm.aead != nil {
+		nonce := make([]byte, bm.aead.NonceSize(), bm.aead.NonceSize()+len(data)+bm.aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		data = bm.aead.Seal(nonce, nonce, data, additionalData(blocknum))
+	}
+	return data, nil
+}
+
+// decode按照块header中记录的transform还原出原始的entries数据
+func (bm *BlockManager) decode(b *Block) ([]byte, error) {
+	used := int(b.Header.UsedSize)
+	if used < 0 || used > BodySize {
+		return nil, ErrUnmarshalFailed
+	}
+	data := b.EntriesData[:used]
+	t := b.Header.Transform
+	if t == TransformNone {
+		return data, nil
+	}
+	if t&^knownTransforms != 0 {
+		return nil, ErrUnknownTransform
+	}
+
+	if t&TransformAESGCM != 0 {
+		if bm.aead == nil {
+			return nil, ErrMissingKey
+		}
+		ns := bm.aead.NonceSize()
+		if len(data) < ns {
+			return nil, ErrTransformFailed
+		}
+		var err error
+		data, err = bm.aead.Open(nil, data[:ns], data[ns:], additionalData(b.Header.BlockNum))
+		if err != nil {
+			return nil, errors.Wrap(ErrTransformFailed, err.Error())
+		}
+	}
+
+	var err error
+	switch t & compressionMask {
+	case TransformNone:
+	case TransformSnappy:
+		data, err = snappy.Decode(nil, data)
+	case TransformZstd:
+		initZstd()
+		data, err = zstdDecoder.DecodeAll(data, nil)
+	default:
+		return nil, ErrUnknownTransform
+	}
+	if err != nil {
+		return nil, errors.Wrap(ErrTransformFailed, err.Error())
+	}
+	return data, nil
+}
+
+// parseEntries解析原始的entries数据,会检查每个entry的边界,
+// 遇到损坏的数据时返回已经成功解析出的entries以及ErrUnmarshalFailed而不会panic
+func parseEntries(data []byte, nums int16) ([][]byte, error) {
+	if nums < 0 {
+		return nil, ErrUnmarshalFailed
+	}
+	p := 0
+	res := make([][]byte, 0, nums)
+	for range nums {
+		if p+2 > len(data) {
+			return res, ErrUnmarshalFailed
+		}
+		entrySize := int(int16(binary.LittleEndian.Uint16(data[p : p+2])))
+		p += 2
+		if entrySize < 0 || p+entrySize > len(data) {
+			return res, ErrUnmarshalFailed
+		}
+		e := make([]byte, entrySize)
+		copy(e, data[p:p+entrySize])
+		res = append(res, e)
+		p += entrySize
+	}
+	return res, nil
+}
+
+// BlockEntries解码一个块并返回其中所有的entries,块可以使用任意transform写入
+func (bm *BlockManager) BlockEntries(b *Block) ([][]byte, error) {
+	data, err := bm.decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return parseEntries(data, b.Header.EntryNums)
+}
@@ -3,6 +3,7 @@ package redlock
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/hkensame/goken/pkg/errors"
@@ -19,6 +20,7 @@ type RedLock struct {
 	addr     []string
 	password string
 	sync     *redsync.Redsync
+	once     sync.Once
 	//用于检测addr,password是否改变过
 	UseCluster bool
 	//如果未抢到锁则休眠的时间,若为0则不休眠直接退出(不尝试自旋)
@@ -79,10 +81,10 @@ func (r *RedLock) newPool(cluster bool) []redpool.Pool {
 }
 
 func (r *RedLock) NewMutex(name string, opts ...redsync.Option) *redsync.Mutex {
-	if r.sync == nil {
-		p := r.newPool(r.UseCluster)
-		r.sync = redsync.New(p...)
-	}
+	//并发的首次调用只能创建一次连接池
+	r.once.Do(func() {
+		r.sync = redsync.New(r.newPool(r.UseCluster)...)
+	})
 	return r.sync.NewMutex(name, opts...)
 }
 
@@ -174,10 +174,13 @@ func ExtractSpanFormCtx(ctx context.Context, opts ...trace.TracerOption) (trace.
 	return otel.Tracer(traceName, opts...), ctx
 }
 
-// 将ctx中的span信息注入到metadata中
+// 将ctx中的span信息注入到outgoing metadata中,只传播trace相关的header,
+// incoming metadata中的其它header(如authorization)不会被转发,需要转发token时使用rpcserver.WithForwardJWT
 func NewSpanOutgoingContext(ctx context.Context, span trace.Span) context.Context {
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
 		md = metadata.MD{}
 	}
 
@@ -21,6 +21,7 @@ type builder struct {
 	discover registry.Discover
 	timeout  time.Duration
 	insecure bool
+	detector *OutlierDetector
 }
 
 type DiscoverModel string
@@ -28,6 +29,8 @@ type DiscoverModel string
 const (
 	ConsulModel DiscoverModel = "consul"
 	EtcdModel   DiscoverModel = "etcd"
+	FileModel   DiscoverModel = "file"
+	MemoryModel DiscoverModel = "memory"
 )
 
 // NewBuilder创建一个用于registry解析程序的构建器
@@ -35,7 +38,7 @@ func MustNewBuilder(discover registry.Discover, opts ...BuilderOption) resolver.
 	builder := &builder{
 		discover: discover,
 		timeout:  time.Second * 10,
-		insecure: false,
+		insecure: true,
 	}
 	for _, o := range opts {
 		o(builder)
@@ -43,23 +46,38 @@ func MustNewBuilder(discover registry.Discover, opts ...BuilderOption) resolver.
 	return builder
 }
 
+// target形如discovery:///service?version=v2&zone=a,query参数会被解析为registry.Selector,只发现满足条件的实例
 func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
-	var err error
-	var listener registry.Listener
-	done := make(chan struct{}, 1)
+	selector, err := registry.SelectorFromQuery(target.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		listener registry.Listener
+		err      error
+	}
+	res := make(chan result, 1)
 	//创建最顶层的ctx,用于后续流程控制
 	ctx, cancel := context.WithCancel(context.Background())
 	//这里采取了观察者模式,这个协程等待服务推送,只有有服务推送这里listener才能被创建
 	go func() {
 		//异步创建Listener,该接口由具体的注册中心提供
-		listener, err = b.discover.NewListener(ctx, strings.TrimPrefix(target.URL.Path, "/"))
-		close(done)
+		l, err := b.discover.NewListener(ctx, strings.TrimPrefix(target.URL.Path, "/"), selector)
+		res <- result{listener: l, err: err}
 	}()
+	var listener registry.Listener
 	select {
 	//等待listener被建立成功
-	case <-done:
+	case r := <-res:
+		listener, err = r.listener, r.err
 	case <-time.After(b.timeout):
 		err = errors.New("discover创建超时")
+		//超时之后才创建成功的listener同样需要停止,否则它共享的快照与轮询协程不会被释放
+		go func() {
+			if r := <-res; r.err == nil {
+				r.listener.StopListen(context.Background())
+			}
+		}()
 	}
 	if err != nil {
 		cancel()
@@ -71,6 +89,10 @@ func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts res
 		ctx:      ctx,
 		cancel:   cancel,
 		insecure: b.insecure,
+		detector: b.detector,
+	}
+	if b.detector != nil {
+		b.detector.subscribe(resolver)
 	}
 
 	go resolver.listen()
@@ -88,8 +110,16 @@ func WithTimeout(timeout time.Duration) BuilderOption {
 	}
 }
 
+// 客户端是否使用非TLS连接,默认为true,为false时优先使用grpcs(或tls=true)的endpoint
 func WithInsecure(insecure bool) BuilderOption {
 	return func(b *builder) {
 		b.insecure = insecure
 	}
 }
+
+// 开启客户端离群检测,detector同时需要以拦截器的形式加入到客户端中才能收集到请求结果
+func WithOutlierDetector(d *OutlierDetector) BuilderOption {
+	return func(b *builder) {
+		b.detector = d
+	}
+}
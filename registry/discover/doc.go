@@ -7,3 +7,6 @@ package discover
 
 //resolver.Resolver是具体的服务发现逻辑,负责获取服务地址列表并维护服务变化的通知,
 //你需要实现ResolveNow方法来查询和返回当前的服务地址信息
+
+//客户端Dial的target形如discovery:///service,可以通过query参数只选择服务的一部分实例,
+//例如discovery:///service?version=v2&zone=a&tag=canary,version支持>=v1.2,<v2这样的约束,tag可以重复,其余参数按metadata匹配
@@ -14,6 +14,8 @@ import (
 
 type KDtmOption func(*kDtmDriver)
 
+// kDtmDriver实现了dtm的dtmdriver.Driver接口,使dtm可以通过goken的注册中心注册与发现服务
+// 使用时需调用dtmdriver.Register(MustNewKDtmDriver(...)),dtm与业务服务中的driver均设置为GetName()的返回值
 func MustNewKDtmDriver(ctx context.Context, b resolver.Builder, opts ...KDtmOption) *kDtmDriver {
 	k := &kDtmDriver{
 		Ctx:     ctx,
@@ -29,39 +31,82 @@ type kDtmDriver struct {
 	Register registry.Registor
 	Builder  resolver.Builder
 	Ctx      context.Context
+	//除discovery外额外注册的resolver scheme,例如consul,只能通过WithSchemes设置
+	schemes []string
 }
 
 func (s *kDtmDriver) GetName() string {
 	return "dtm-driver-goken"
 }
 
+// 注册discovery://的resolver,设置了WithSchemes时同时以额外的scheme(例如consul://)注册同一个resolver,
+// 此时dtm中既可以使用discovery:///service也可以使用consul://127.0.0.1:8500/service,
+// 注意resolver是进程内全局注册的,额外的scheme会覆盖同名的resolver(例如grpc-consul-resolver)
 func (b *kDtmDriver) RegisterAddrResolver() {
-	if b.Builder != nil {
-		resolver.Register(b.Builder)
+	if b.Builder == nil {
+		return
+	}
+	resolver.Register(b.Builder)
+	for _, scheme := range b.schemes {
+		if scheme != b.Builder.Scheme() {
+			resolver.Register(&schemeBuilder{Builder: b.Builder, scheme: scheme})
+		}
 	}
 }
 
+// target为服务在注册中心中的地址,例如discovery:///dtmservice或consul://127.0.0.1:8500/dtmservice,
+// endpoint为服务监听的地址,例如grpc://127.0.0.1:36790,省略scheme时视为grpc
 func (b *kDtmDriver) RegisterService(target string, endpoint string) error {
-	//先不注册,看看这个target和endpoint传入的是什么
-	// if b.Register != nil {
-	// 	b.Register.Register(b.Ctx,&registry.ServiceInstance{
-	// 		ID: fmt.Sprintf("dtm-driver-goken"),
-	// 	})
-	// }
-	fmt.Println(target, endpoint)
-	return nil
+	if target == "" || b.Register == nil {
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return errors.Wrapf(err, "target格式错误 target = %s", target)
+	}
+	name := strings.Trim(u.Path, "/")
+	if name == "" {
+		return errors.Errorf("target中缺少服务名 target = %s", target)
+	}
+
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "grpc://" + endpoint
+	}
+	e, err := url.Parse(endpoint)
+	if err != nil || e.Host == "" {
+		return errors.Errorf("endpoint格式错误 endpoint = %s", endpoint)
+	}
+	return b.Register.Register(b.Ctx, &registry.ServiceInstance{
+		//同一服务的同一地址总是得到相同的id,dtm重启后重新注册会覆盖旧的实例
+		ID:        fmt.Sprintf("%s-%s", name, e.Host),
+		Name:      name,
+		Endpoints: []*url.URL{e},
+	})
 }
 
+// uri形如discovery:///service/pkg.Service/Method或consul://127.0.0.1:8500/service/pkg.Service/Method,
+// 没有scheme时视为直连地址,例如127.0.0.1:9000/pkg.Service/Method
 func (b *kDtmDriver) ParseServerMethod(uri string) (server string, method string, err error) {
+	if !strings.Contains(uri, "://") {
+		i := strings.Index(uri, "/")
+		if i <= 0 {
+			return "", "", errors.New("uri格式错误,无法解析出server与full method")
+		}
+		return uri[:i], uri[i:], nil
+	}
+
 	u, err := url.Parse(uri)
 	if err != nil {
 		return "", "", err
 	}
 	service := strings.Split(u.Path, "/")
-	if len(service) != 4 {
+	if len(service) != 4 || service[1] == "" || service[2] == "" || service[3] == "" {
 		return "", "", errors.New("uri格式错误,无法解析出server-name与full method")
 	}
 	server = fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, service[1])
+	if u.RawQuery != "" {
+		server += "?" + u.RawQuery
+	}
 	method = fmt.Sprintf("/%s/%s", service[2], service[3])
 	return
 }
@@ -71,3 +116,27 @@ func WithRegistor(r registry.Registor) KDtmOption {
 		kdd.Register = r
 	}
 }
+
+// 使用d创建discovery的resolver,需要以d的注册中心类型(如consul)作为scheme时使用WithSchemes
+func WithDiscover(d registry.Discover, opts ...BuilderOption) KDtmOption {
+	return func(kdd *kDtmDriver) {
+		kdd.Builder = MustNewBuilder(d, opts...)
+	}
+}
+
+// 额外以scheme全局注册resolver,例如WithSchemes("consul")
+func WithSchemes(schemes ...string) KDtmOption {
+	return func(kdd *kDtmDriver) {
+		kdd.schemes = append(kdd.schemes, schemes...)
+	}
+}
+
+// schemeBuilder以另一个scheme注册同一个resolver.Builder
+type schemeBuilder struct {
+	resolver.Builder
+	scheme string
+}
+
+func (b *schemeBuilder) Scheme() string {
+	return b.scheme
+}
@@ -0,0 +1,111 @@
+package discover
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hkensame/goken/registry/ways/memory"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestDtmDriverRegisterService(t *testing.T) {
+	ctx := context.Background()
+	mem := memory.MustNewMemoryRegistry()
+	d := MustNewKDtmDriver(ctx, nil, WithRegistor(mem))
+
+	if err := d.RegisterService("discovery:///dtmservice", "127.0.0.1:36790"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RegisterService("consul://127.0.0.1:8500/busi", "http://127.0.0.1:8081"); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, ins := range mem.List() {
+		got[ins.Name] = ins.ID + " " + ins.Endpoints[0].String()
+	}
+	if got["dtmservice"] != "dtmservice-127.0.0.1:36790 grpc://127.0.0.1:36790" {
+		t.Fatalf("discovery target注册结果有误 %v", got)
+	}
+	if got["busi"] != "busi-127.0.0.1:8081 http://127.0.0.1:8081" {
+		t.Fatalf("consul target注册结果有误 %v", got)
+	}
+
+	for _, bad := range [][2]string{{"discovery:///", "127.0.0.1:1"}, {"discovery:///svc", "grpc://"}} {
+		if err := d.RegisterService(bad[0], bad[1]); err == nil {
+			t.Fatalf("target = %s, endpoint = %s 应当注册失败", bad[0], bad[1])
+		}
+	}
+}
+
+func TestDtmDriverParseServerMethod(t *testing.T) {
+	d := MustNewKDtmDriver(context.Background(), nil)
+	cases := []struct {
+		uri, server, method string
+	}{
+		{"discovery:///busi/busi.Busi/TransIn", "discovery:///busi", "/busi.Busi/TransIn"},
+		{"consul://127.0.0.1:8500/busi/busi.Busi/TransIn", "consul://127.0.0.1:8500/busi", "/busi.Busi/TransIn"},
+		{"consul://127.0.0.1:8500/busi/busi.Busi/TransIn?dc=dc1", "consul://127.0.0.1:8500/busi?dc=dc1", "/busi.Busi/TransIn"},
+		{"127.0.0.1:9000/busi.Busi/TransIn", "127.0.0.1:9000", "/busi.Busi/TransIn"},
+	}
+	for _, c := range cases {
+		server, method, err := d.ParseServerMethod(c.uri)
+		if err != nil || server != c.server || method != c.method {
+			t.Fatalf("uri = %s, server = %s, method = %s, err = %v", c.uri, server, method, err)
+		}
+	}
+	for _, uri := range []string{"discovery:///busi", "consul://127.0.0.1:8500/busi/Method", "/busi.Busi/TransIn"} {
+		if _, _, err := d.ParseServerMethod(uri); err == nil {
+			t.Fatalf("uri = %s 应当解析失败", uri)
+		}
+	}
+}
+
+func TestDtmDriverRegisterAddrResolver(t *testing.T) {
+	ctx := context.Background()
+	mem := memory.MustNewMemoryRegistry()
+
+	//没有WithSchemes时只注册discovery,不会占用注册中心类型对应的scheme
+	MustNewKDtmDriver(ctx, nil, WithDiscover(mem)).RegisterAddrResolver()
+	if resolver.Get("discovery") == nil {
+		t.Fatal("discovery resolver没有被注册")
+	}
+	if resolver.Get(mem.RegisrtyName()) != nil {
+		t.Fatalf("%s resolver不应被注册", mem.RegisrtyName())
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	go s.Serve(lis)
+	defer s.Stop()
+
+	d := MustNewKDtmDriver(ctx, nil, WithRegistor(mem), WithDiscover(mem, WithInsecure(true)), WithSchemes("consul"))
+	d.RegisterAddrResolver()
+	if err := d.RegisterService("consul://127.0.0.1:8500/busi", lis.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"discovery:///busi", "consul://127.0.0.1:8500/busi"} {
+		cc, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tctx, cancel := context.WithTimeout(ctx, time.Second*5)
+		_, err = healthpb.NewHealthClient(cc).Check(tctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+		cancel()
+		cc.Close()
+		if err != nil {
+			t.Fatalf("target = %s err = %v", target, err)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package discover
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hkensame/goken/pkg/common/pickutil"
+	"github.com/hkensame/goken/pkg/log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+// OutlierConfig是客户端离群检测的配置,零值字段使用默认值
+type OutlierConfig struct {
+	//连续失败多少次后摘除实例,默认为5,小于0表示不按连续失败摘除
+	ConsecutiveFailures int
+	//统计周期内错误率达到该值后摘除实例,默认为0.5,小于0表示不按错误率摘除
+	ErrorRate float64
+	//统计周期内请求数达到该值后才会按错误率判断,默认为20
+	MinRequests int
+	//错误率的统计周期,默认为10s
+	Interval time.Duration
+	//第一次被摘除的时长,之后每次被摘除时长翻倍,默认为30s
+	BaseEjectionTime time.Duration
+	//摘除时长的上限,默认为5m
+	MaxEjectionTime time.Duration
+	//最多同时摘除的实例比例,默认为0.5,至少会保留一个实例
+	MaxEjectedFraction float64
+}
+
+func (c *OutlierConfig) withDefaults() OutlierConfig {
+	cfg := OutlierConfig{}
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.ConsecutiveFailures == 0 {
+		cfg.ConsecutiveFailures = 5
+	}
+	if cfg.ErrorRate == 0 {
+		cfg.ErrorRate = 0.5
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second * 10
+	}
+	if cfg.BaseEjectionTime <= 0 {
+		cfg.BaseEjectionTime = time.Second * 30
+	}
+	if cfg.MaxEjectionTime <= 0 {
+		cfg.MaxEjectionTime = time.Minute * 5
+	}
+	if cfg.MaxEjectedFraction <= 0 || cfg.MaxEjectedFraction > 1 {
+		cfg.MaxEjectedFraction = 0.5
+	}
+	return cfg
+}
+
+// OutlierDetector根据客户端观察到的请求结果摘除持续失败的实例,
+// 注册中心的健康检查通常有数十秒的延迟,离群检测可以更快地把故障实例从负载均衡中移除
+// 一个OutlierDetector应只用于一个目标服务,通过拦截器收集请求结果,通过Resolver过滤被摘除的地址
+type OutlierDetector struct {
+	cfg OutlierConfig
+
+	//key为实例地址(host:port)
+	hosts map[string]*hostStat
+	//最近一次resolver推送的地址,用于计算摘除比例
+	known     map[string]struct{}
+	resolvers map[*Resolver]struct{}
+	lock      sync.Mutex
+}
+
+type hostStat struct {
+	consecutive int
+	total       int
+	failed      int
+	windowStart time.Time
+
+	ejectedUntil time.Time
+	//连续被摘除的次数,决定下一次摘除的时长
+	ejections int
+	//最后一次恢复的时间,长时间未再被摘除时清零ejections
+	restoredAt time.Time
+}
+
+func NewOutlierDetector(cfg *OutlierConfig) *OutlierDetector {
+	return &OutlierDetector{
+		cfg:       cfg.withDefaults(),
+		hosts:     make(map[string]*hostStat),
+		known:     make(map[string]struct{}),
+		resolvers: make(map[*Resolver]struct{}),
+	}
+}
+
+// 只有体现实例本身故障的错误才被计为失败,业务错误(如参数错误,未找到)不影响实例的健康
+func isOutlierFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+// Record记录一次发往addr的请求结果
+func (d *OutlierDetector) Record(addr string, err error) {
+	now := time.Now()
+	failed := err != nil && isOutlierFailure(err)
+
+	d.lock.Lock()
+	h, ok := d.hosts[addr]
+	if !ok {
+		h = &hostStat{windowStart: now}
+		d.hosts[addr] = h
+	}
+	if now.Sub(h.windowStart) > d.cfg.Interval {
+		h.total, h.failed, h.windowStart = 0, 0, now
+	}
+	h.total++
+	if !failed {
+		h.consecutive = 0
+		if h.ejections > 0 && !h.restoredAt.IsZero() && now.Sub(h.restoredAt) > d.cfg.MaxEjectionTime {
+			h.ejections = 0
+		}
+		d.lock.Unlock()
+		return
+	}
+	h.failed++
+	h.consecutive++
+
+	eject := now.After(h.ejectedUntil) &&
+		((d.cfg.ConsecutiveFailures > 0 && h.consecutive >= d.cfg.ConsecutiveFailures) ||
+			(d.cfg.ErrorRate > 0 && h.total >= d.cfg.MinRequests && float64(h.failed)/float64(h.total) >= d.cfg.ErrorRate))
+	if eject && !d.canEject(now) {
+		eject = false
+	}
+	var dur time.Duration
+	if eject {
+		dur = d.cfg.BaseEjectionTime << min(h.ejections, 16)
+		if dur <= 0 || dur > d.cfg.MaxEjectionTime {
+			dur = d.cfg.MaxEjectionTime
+		}
+		h.ejectedUntil = now.Add(dur)
+		h.ejections++
+		h.consecutive, h.total, h.failed, h.windowStart = 0, 0, 0, now
+		h.restoredAt = h.ejectedUntil
+	}
+	d.lock.Unlock()
+
+	if eject {
+		log.Warnf("[discover] 实例%s被离群检测摘除%v", addr, dur)
+		d.refresh()
+		time.AfterFunc(dur, func() {
+			log.Infof("[discover] 实例%s结束摘除", addr)
+			d.refresh()
+		})
+	}
+}
+
+// canEject判断再摘除一个实例后是否超过最大摘除比例,调用者需持有d.lock
+func (d *OutlierDetector) canEject(now time.Time) bool {
+	if len(d.known) <= 1 {
+		return false
+	}
+	ejected := 0
+	for addr := range d.known {
+		if h, ok := d.hosts[addr]; ok && now.Before(h.ejectedUntil) {
+			ejected++
+		}
+	}
+	return float64(ejected+1) <= float64(len(d.known))*d.cfg.MaxEjectedFraction && ejected+1 < len(d.known)
+}
+
+// Ejected判断addr当前是否处于被摘除状态
+func (d *OutlierDetector) Ejected(addr string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	h, ok := d.hosts[addr]
+	return ok && time.Now().Before(h.ejectedUntil)
+}
+
+// filter去掉被摘除的地址,同时记录当前的地址集合
+func (d *OutlierDetector) filter(addrs []resolver.Address) []resolver.Address {
+	now := time.Now()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.known = make(map[string]struct{}, len(addrs))
+	for _, a := range addrs {
+		d.known[a.Addr] = struct{}{}
+	}
+	//已经不存在的实例无需继续统计
+	for addr := range d.hosts {
+		if _, ok := d.known[addr]; !ok {
+			delete(d.hosts, addr)
+		}
+	}
+
+	res := make([]resolver.Address, 0, len(addrs))
+	for _, a := range addrs {
+		if h, ok := d.hosts[a.Addr]; ok && now.Before(h.ejectedUntil) {
+			continue
+		}
+		res = append(res, a)
+	}
+	if len(res) == 0 {
+		return addrs
+	}
+	return res
+}
+
+func (d *OutlierDetector) subscribe(r *Resolver) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.resolvers[r] = struct{}{}
+}
+
+func (d *OutlierDetector) unsubscribe(r *Resolver) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.resolvers, r)
+}
+
+// refresh让所有resolver以最新的摘除状态重新推送地址
+func (d *OutlierDetector) refresh() {
+	d.lock.Lock()
+	rs := make([]*Resolver, 0, len(d.resolvers))
+	for r := range d.resolvers {
+		rs = append(rs, r)
+	}
+	d.lock.Unlock()
+	for _, r := range rs {
+		r.refresh()
+	}
+}
+
+// 收集一元请求的结果,实例地址取自负载均衡器选中的resolver地址,从而与filter中的地址一致
+func (d *OutlierDetector) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		p := &pickutil.Picked{}
+		err := invoker(pickutil.NewContext(ctx, p), method, req, reply, cc, opts...)
+		if addr := p.Addr(); addr != "" {
+			d.Record(addr, err)
+		}
+		return err
+	}
+}
+
+// 收集流式请求的结果,以流结束时的状态为准
+func (d *OutlierDetector) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		p := &pickutil.Picked{}
+		cs, err := streamer(pickutil.NewContext(ctx, p), desc, cc, method, opts...)
+		if err != nil {
+			if addr := p.Addr(); addr != "" {
+				d.Record(addr, err)
+			}
+			return nil, err
+		}
+		return &outlierStream{ClientStream: cs, d: d, p: p}, nil
+	}
+}
+
+type outlierStream struct {
+	grpc.ClientStream
+	d    *OutlierDetector
+	p    *pickutil.Picked
+	once sync.Once
+}
+
+func (s *outlierStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.once.Do(func() {
+			addr := s.p.Addr()
+			if addr == "" {
+				return
+			}
+			if err == io.EOF {
+				s.d.Record(addr, nil)
+			} else {
+				s.d.Record(addr, err)
+			}
+		})
+	}
+	return err
+}
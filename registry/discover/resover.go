@@ -3,6 +3,8 @@ package discover
 import (
 	"context"
 	"errors"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/hkensame/goken/pkg/log"
@@ -23,7 +25,14 @@ type Resolver struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	//客户端是否使用非TLS连接,决定优先使用grpc还是grpcs的endpoint
 	insecure bool
+
+	//为nil时不进行离群检测
+	detector *OutlierDetector
+	//最近一次从注册中心得到的实例,离群检测的摘除状态变化时据此重新推送
+	last []*registry.ServiceInstance
+	lock sync.Mutex
 }
 
 // 服务发现的核心逻辑,同样是失败无限重试
@@ -44,26 +53,40 @@ func (r *Resolver) listen() {
 			time.Sleep(time.Second)
 			continue
 		}
-		if len(ins) == 0 {
-			continue
-		}
-		//一旦发现新的节点信息就更新到grpc内部中
+		//一旦发现新的节点信息就更新到grpc内部中,实例全部下线时同样需要更新
+		r.update(ins)
+	}
+}
+
+// refresh以最近一次的实例列表重新推送地址
+func (r *Resolver) refresh() {
+	r.lock.Lock()
+	ins := r.last
+	r.lock.Unlock()
+	if ins != nil {
 		r.update(ins)
 	}
 }
 
 // 用于更新服务发现的实例列表
 func (r *Resolver) update(ins []*registry.ServiceInstance) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.last = ins
 	addrs := make([]resolver.Address, 0)
 	// 使用一个map来存储已处理的新发现的endpoint地址,避免冗余
 	endpoints := make(map[string]struct{})
 
 	for _, in := range ins {
-		// ParseEndpoint 这里暂时先只考虑grpc,后续开放更多类型的协议
-		// 这里似乎函数有问题
-
-		for _, e := range in.Endpoints {
-			endpoint := e.Host
+		//同一实例可能同时注册了http与grpc的endpoint,这里只使用grpc的endpoint,
+		//没有任何grpc endpoint的老版本实例则使用它所有的endpoint
+		eps := in.EndpointsByProtocol(registry.ProtocolGRPC, registry.ProtocolGRPCS)
+		if len(eps) == 0 {
+			eps = in.TypedEndpoints()
+		}
+		eps = r.matchTLS(eps)
+		for _, e := range eps {
+			endpoint := e.Address
 			// 如果解析结果为空的endpoint,跳过此服务实例
 			if endpoint == "" {
 				continue
@@ -78,35 +101,55 @@ func (r *Resolver) update(ins []*registry.ServiceInstance) {
 			// 构建一个resolver.Address对象,用于表示一个服务的地址信息
 			addr := resolver.Address{
 				ServerName: in.Name,
-				//该字段类似于metadata,记录任何需要的元数据
-				Attributes: parseAttributes(in.Metadata),
+				//该字段类似于metadata,记录任何需要的元数据,endpoint自身的权重与zone优先于实例的metadata
+				Attributes: parseAttributes(endpointMetadata(in.Metadata, e)),
 				Addr:       endpoint,
 			}
-
-			// 可以为resolver.Address添加一个自定义属性,存储原始的ServiceInstance信息
-			//addr.Attributes = addr.Attributes.WithValue("rawServiceInstance", in)
 			addrs = append(addrs, addr)
 		}
 
 	}
 
-	// 如果没有有效的地址信息但是却触发了update函数,需要记录警告日志
+	// 没有有效的地址时同样推送空的地址列表,让负载均衡器关闭已经下线的连接,而不是继续使用过期的地址
 	if len(addrs) == 0 {
 		log.Warnf("[discover] resolver未发现有效的地址信息, instances= %v", ins)
-		return
+	}
+
+	//离群检测摘除的实例不交给负载均衡器
+	if r.detector != nil {
+		addrs = r.detector.filter(addrs)
 	}
 
 	// grpc给出的接口,是grpc内部获得,更新连接的核心代码
 	err := r.cc.UpdateState(resolver.State{Addresses: addrs})
-	if err != nil {
+	//地址为空时负载均衡器总是返回ErrBadResolverState,上面已经记录过
+	if err != nil && len(addrs) > 0 {
 		log.Errorf("[discover] resolver服务更新失败, err= %v", err)
 	}
 
 	//可以在最后打日志记录:更新/修改了某个服务以便快速得知信息变更
 }
 
+// matchTLS在实例同时注册了TLS与非TLS的endpoint时,只保留与客户端连接方式一致的endpoint,
+// 只有一种endpoint时原样返回,连接方式不一致时由握手失败体现
+func (r *Resolver) matchTLS(eps []registry.Endpoint) []registry.Endpoint {
+	res := make([]registry.Endpoint, 0, len(eps))
+	for _, e := range eps {
+		if e.TLS != r.insecure {
+			res = append(res, e)
+		}
+	}
+	if len(res) == 0 {
+		return eps
+	}
+	return res
+}
+
 func (r *Resolver) Close() {
 	r.cancel()
+	if r.detector != nil {
+		r.detector.unsubscribe(r)
+	}
 	err := r.listener.StopListen(context.TODO())
 	if err != nil {
 		log.Errorf("[discover] resolver停止监听服务失败, err= %s", err)
@@ -126,3 +169,20 @@ func parseAttributes(md map[string]string) *attributes.Attributes {
 	}
 	return a
 }
+
+func endpointMetadata(md map[string]string, e registry.Endpoint) map[string]string {
+	if e.Weight == 0 && e.Zone == "" {
+		return md
+	}
+	res := make(map[string]string, len(md)+2)
+	for k, v := range md {
+		res[k] = v
+	}
+	if e.Weight != 0 {
+		res["weight"] = strconv.Itoa(e.Weight)
+	}
+	if e.Zone != "" {
+		res["zone"] = e.Zone
+	}
+	return res
+}
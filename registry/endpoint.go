@@ -0,0 +1,106 @@
+package registry
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 常用的endpoint协议
+const (
+	ProtocolGRPC  = "grpc"
+	ProtocolGRPCS = "grpcs"
+	ProtocolHTTP  = "http"
+	ProtocolHTTPS = "https"
+)
+
+// Endpoint是ServiceInstance.Endpoints中一个地址的结构化表示,
+// 除协议与地址外的属性编码在url的query中,例如grpc://10.0.0.1:9000?weight=10&zone=a&tls=true,
+// 因此在只保存url字符串的注册中心中也能完整地往返
+type Endpoint struct {
+	//grpc,grpcs,http,https等
+	Protocol string
+	//host:port
+	Address string
+	//负载均衡权重,0表示未设置
+	Weight int
+	//实例所在的可用区,为空时使用实例metadata中的zone
+	Zone string
+	//是否需要使用TLS连接,grpcs与https总是为true
+	TLS bool
+}
+
+// ParseEndpoint把url解析为Endpoint,无法识别的query参数会被忽略
+func ParseEndpoint(u *url.URL) Endpoint {
+	q := u.Query()
+	e := Endpoint{
+		Protocol: u.Scheme,
+		Address:  u.Host,
+		Zone:     q.Get("zone"),
+	}
+	e.Weight, _ = strconv.Atoi(q.Get("weight"))
+	e.TLS, _ = strconv.ParseBool(q.Get("tls"))
+	if u.Scheme == ProtocolGRPCS || u.Scheme == ProtocolHTTPS {
+		e.TLS = true
+	}
+	return e
+}
+
+// URL把Endpoint编码为url,只有非零值的属性才会写入query
+func (e Endpoint) URL() *url.URL {
+	q := url.Values{}
+	if e.Weight != 0 {
+		q.Set("weight", strconv.Itoa(e.Weight))
+	}
+	if e.Zone != "" {
+		q.Set("zone", e.Zone)
+	}
+	if e.TLS && e.Protocol != ProtocolGRPCS && e.Protocol != ProtocolHTTPS {
+		q.Set("tls", "true")
+	}
+	return &url.URL{Scheme: e.Protocol, Host: e.Address, RawQuery: q.Encode()}
+}
+
+func (e Endpoint) String() string {
+	return e.URL().String()
+}
+
+// IsGRPC判断该endpoint是否为grpc协议
+func (e Endpoint) IsGRPC() bool {
+	return e.Protocol == ProtocolGRPC || e.Protocol == ProtocolGRPCS
+}
+
+// IsHTTP判断该endpoint是否为http协议
+func (e Endpoint) IsHTTP() bool {
+	return e.Protocol == ProtocolHTTP || e.Protocol == ProtocolHTTPS
+}
+
+// TypedEndpoints返回结构化的endpoints
+func (ins *ServiceInstance) TypedEndpoints() []Endpoint {
+	res := make([]Endpoint, 0, len(ins.Endpoints))
+	for _, u := range ins.Endpoints {
+		if u != nil {
+			res = append(res, ParseEndpoint(u))
+		}
+	}
+	return res
+}
+
+// EndpointsByProtocol返回协议为protocols之一的endpoints,协议名不区分大小写
+func (ins *ServiceInstance) EndpointsByProtocol(protocols ...string) []Endpoint {
+	res := make([]Endpoint, 0, len(ins.Endpoints))
+	for _, e := range ins.TypedEndpoints() {
+		for _, p := range protocols {
+			if strings.EqualFold(e.Protocol, p) {
+				res = append(res, e)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// AddEndpoint向实例中追加一个endpoint
+func (ins *ServiceInstance) AddEndpoint(e Endpoint) {
+	ins.Endpoints = append(ins.Endpoints, e.URL())
+}
@@ -2,6 +2,7 @@ package registry
 
 import (
 	"context"
+	"encoding/json"
 	"net/url"
 
 	"github.com/hkensame/goken/pkg/errors"
@@ -12,7 +13,8 @@ import (
 // 服务发现接口
 type Discover interface {
 	//创建服务监听器,而服务监听器用于从特定的注册中心持续监听Name为serviceName的服务的信息
-	NewListener(ctx context.Context, serviceName string) (Listener, error)
+	//selector用于只监听满足条件的实例,为nil时监听所有实例
+	NewListener(ctx context.Context, serviceName string, selector *Selector) (Listener, error)
 	//返回解析器关联的注册中心的类型:consul,etcd等
 	RegisrtyName() string
 }
@@ -28,8 +30,9 @@ var (
 )
 
 type Listener interface {
-	//第一次监听或者服务实例发生变化时调用会返回服务实例列表
+	//第一次监听或者服务实例发生变化时调用会返回服务当前完整的实例列表(快照)
 	//其它情况下会阻塞直至context超时或服务实例发生变化
+	//同一服务的多个监听器之间互不影响,每个监听器都能看到完整的快照,需要增量变化时可使用EventListener
 	ListenAndGet(context.Context) ([]*ServiceInstance, error)
 	StopListen(context.Context) error
 }
@@ -50,5 +53,55 @@ type ServiceInstance struct {
 	//http://127.0.0.1:8000
 	//grpc://127.0.0.1:9000
 	//一般来说该切片只用当成一个string即可,若想在一台机器上既运行http服务也运行grpc服务即可作切片使用
+	//权重,zone,TLS等属性编码在query中,可以通过TypedEndpoints得到结构化的Endpoint
 	Endpoints []*url.URL `json:"endpoints"`
 }
+
+// 序列化时Endpoints使用原始的url字符串,与consul保存在Meta中的endpoint一致,各注册中心(etcd,file等)存储的json格式保持一致
+type serviceInstanceJSON struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Version   string            `json:"version"`
+	Metadata  map[string]string `json:"metadata"`
+	Endpoints []string          `json:"endpoints"`
+}
+
+func (ins ServiceInstance) MarshalJSON() ([]byte, error) {
+	s := serviceInstanceJSON{
+		ID:        ins.ID,
+		Name:      ins.Name,
+		Version:   ins.Version,
+		Metadata:  ins.Metadata,
+		Endpoints: make([]string, 0, len(ins.Endpoints)),
+	}
+	//保存原始的url字符串,未知的query参数与path同样需要保留,结构化的属性只在读取时解析
+	for _, u := range ins.Endpoints {
+		if u != nil {
+			s.Endpoints = append(s.Endpoints, u.String())
+		}
+	}
+	return json.Marshal(s)
+}
+
+func (ins *ServiceInstance) UnmarshalJSON(data []byte) error {
+	var s serviceInstanceJSON
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	endpoints := make([]*url.URL, 0, len(s.Endpoints))
+	for _, e := range s.Endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			return errors.Wrapf(err, "服务%s的endpoint格式有误", s.ID)
+		}
+		endpoints = append(endpoints, u)
+	}
+	*ins = ServiceInstance{
+		ID:        s.ID,
+		Name:      s.Name,
+		Version:   s.Version,
+		Metadata:  s.Metadata,
+		Endpoints: endpoints,
+	}
+	return nil
+}
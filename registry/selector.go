@@ -0,0 +1,249 @@
+package registry
+
+import (
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/hkensame/goken/pkg/errors"
+)
+
+var ErrInvalidSelector = errors.New("服务选择器格式有误")
+
+// Selector用于从同名服务的所有实例中选出一个子集,各字段之间为与的关系,零值表示不过滤
+type Selector struct {
+	//版本约束,多个约束之间用逗号分隔且需要同时满足,支持以下形式:
+	//v2 精确匹配, v2.* 前缀匹配, >=v1.2 >v1.2 <=v1.2 <v2 !=v1.3 按照语义化版本比较
+	Version string
+	//每个tag都需要匹配, k=v 形式的tag等价于Metadata中的k=v(version=x则匹配Version),其余tag要求Metadata中存在该key,
+	//consul会在服务端过滤tag,注册时metadata会以相同的规则写为consul的tag
+	Tags []string
+	//Metadata中必须存在且相等的键值对
+	Metadata map[string]string
+}
+
+// 把discovery://的target中的query参数解析为Selector,
+// version与tag(可重复)为保留参数,其余参数均作为metadata匹配,例如?version=v2&zone=a
+func SelectorFromQuery(q url.Values) (*Selector, error) {
+	if len(q) == 0 {
+		return nil, nil
+	}
+	s := &Selector{}
+	for k, vs := range q {
+		switch k {
+		case "version":
+			s.Version = strings.Join(vs, ",")
+		case "tag":
+			s.Tags = append(s.Tags, vs...)
+		default:
+			if len(vs) != 1 {
+				return nil, errors.Wrapf(ErrInvalidSelector, "metadata %s 只能指定一个值", k)
+			}
+			if s.Metadata == nil {
+				s.Metadata = make(map[string]string)
+			}
+			s.Metadata[k] = vs[0]
+		}
+	}
+	slices.Sort(s.Tags)
+	return s, s.Validate()
+}
+
+func (s *Selector) Empty() bool {
+	return s == nil || (s.Version == "" && len(s.Tags) == 0 && len(s.Metadata) == 0)
+}
+
+func (s *Selector) Validate() error {
+	if s == nil || s.Version == "" {
+		return nil
+	}
+	for _, c := range strings.Split(s.Version, ",") {
+		if _, _, err := parseConstraint(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String返回Selector的规范形式,相同条件的Selector返回值相同,可以用作缓存的key
+func (s *Selector) String() string {
+	if s.Empty() {
+		return ""
+	}
+	q := url.Values{}
+	if s.Version != "" {
+		q.Set("version", s.Version)
+	}
+	tags := slices.Clone(s.Tags)
+	slices.Sort(tags)
+	for _, t := range tags {
+		q.Add("tag", t)
+	}
+	for _, k := range slices.Sorted(maps.Keys(s.Metadata)) {
+		q.Set(k, s.Metadata[k])
+	}
+	return q.Encode()
+}
+
+func (s *Selector) Match(ins *ServiceInstance) bool {
+	if s.Empty() {
+		return true
+	}
+	if s.Version != "" && !MatchVersion(s.Version, ins.Version) {
+		return false
+	}
+	for _, t := range s.Tags {
+		if !matchTag(t, ins) {
+			return false
+		}
+	}
+	for k, v := range s.Metadata {
+		if got, ok := ins.Metadata[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter返回ins中满足条件的实例
+func (s *Selector) Filter(ins []*ServiceInstance) []*ServiceInstance {
+	if s.Empty() {
+		return ins
+	}
+	res := make([]*ServiceInstance, 0, len(ins))
+	for _, in := range ins {
+		if s.Match(in) {
+			res = append(res, in)
+		}
+	}
+	return res
+}
+
+func matchTag(tag string, ins *ServiceInstance) bool {
+	k, v, ok := strings.Cut(tag, "=")
+	if !ok {
+		_, exist := ins.Metadata[tag]
+		return exist
+	}
+	if k == "version" {
+		return ins.Version == v
+	}
+	got, exist := ins.Metadata[k]
+	return exist && got == v
+}
+
+// MatchVersion判断version是否满足constraint,格式有误的约束不匹配任何版本
+func MatchVersion(constraint, version string) bool {
+	for _, c := range strings.Split(constraint, ",") {
+		op, want, err := parseConstraint(c)
+		if err != nil {
+			return false
+		}
+		switch op {
+		case "":
+			if version != want {
+				return false
+			}
+		case "*":
+			if version != want && !strings.HasPrefix(version, want+".") {
+				return false
+			}
+		default:
+			cmp, ok := compareVersion(version, want)
+			if !ok {
+				return false
+			}
+			switch op {
+			case ">=":
+				ok = cmp >= 0
+			case ">":
+				ok = cmp > 0
+			case "<=":
+				ok = cmp <= 0
+			case "<":
+				ok = cmp < 0
+			case "!=":
+				ok = cmp != 0
+			}
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseConstraint返回约束的操作符与版本号,精确匹配的操作符为空,前缀匹配的操作符为*
+func parseConstraint(c string) (string, string, error) {
+	c = strings.TrimSpace(c)
+	for _, op := range []string{">=", "<=", "!=", ">", "<"} {
+		if v, ok := strings.CutPrefix(c, op); ok {
+			v = strings.TrimSpace(v)
+			if _, ok := parseVersion(v); !ok {
+				return "", "", errors.Wrapf(ErrInvalidSelector, "版本约束 %s 中的版本号无法比较", c)
+			}
+			return op, v, nil
+		}
+	}
+	if c == "" {
+		return "", "", errors.Wrap(ErrInvalidSelector, "版本约束不能为空")
+	}
+	if v, ok := strings.CutSuffix(c, ".*"); ok {
+		return "*", v, nil
+	}
+	if v, ok := strings.CutSuffix(c, ".x"); ok {
+		return "*", v, nil
+	}
+	return "", c, nil
+}
+
+// parseVersion把v1.2.3形式的版本号解析为数字,预发布等后缀(-rc1,+build)会被忽略
+func parseVersion(v string) ([]int, bool) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	if v == "" {
+		return nil, false
+	}
+	parts := strings.Split(v, ".")
+	res := make([]int, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		res = append(res, n)
+	}
+	return res, true
+}
+
+// compareVersion按照语义化版本比较a与b,缺失的部分视为0,即v2等于v2.0.0
+func compareVersion(a, b string) (int, bool) {
+	va, ok := parseVersion(a)
+	if !ok {
+		return 0, false
+	}
+	vb, ok := parseVersion(b)
+	if !ok {
+		return 0, false
+	}
+	for i := 0; i < max(len(va), len(vb)); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, true
+}
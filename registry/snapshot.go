@@ -0,0 +1,206 @@
+package registry
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+)
+
+type EventType int
+
+const (
+	EventAdded EventType = iota + 1
+	EventRemoved
+	EventUpdated
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAdded:
+		return "added"
+	case EventRemoved:
+		return "removed"
+	case EventUpdated:
+		return "updated"
+	}
+	return "unknown"
+}
+
+// 服务实例的一次变化,EventRemoved时Instance为被移除前的实例
+type Event struct {
+	Type     EventType
+	Instance *ServiceInstance
+}
+
+// Update是某个revision下服务的完整快照以及相对于该监听器上一次看到的快照的变化
+type Update struct {
+	//单调递增,每次服务实例发生变化时加1
+	Revision uint64
+	//按照ID排序的完整服务实例列表
+	Instances []*ServiceInstance
+	Events    []Event
+}
+
+// 可选接口,支持该接口的Listener除了完整快照外还能给出相对于上一次的增量变化
+type EventListener interface {
+	Listener
+	//语义与ListenAndGet一致,第一次调用时所有实例都作为EventAdded返回
+	ListenEvents(context.Context) (*Update, error)
+}
+
+// SnapshotStore保存一个服务的最新快照,供同一服务的所有监听器共享,
+// 每个监听器独立记录自己看到的revision,因此多个监听器之间不会相互争抢数据
+type SnapshotStore struct {
+	lock      sync.RWMutex
+	revision  uint64
+	instances []*ServiceInstance
+	//每次更新时关闭并替换,用于广播唤醒所有监听器
+	notify chan struct{}
+}
+
+func NewSnapshotStore() *SnapshotStore {
+	return &SnapshotStore{notify: make(chan struct{})}
+}
+
+// Store用ins替换当前快照,与当前快照相同时不会产生新的revision,返回是否发生了变化
+// 第一次调用总会产生revision,即使ins为空,以便监听器得知服务当前没有实例
+// 存入后ins中的实例会被所有监听器共享,调用者不应再修改它们
+func (s *SnapshotStore) Store(ins []*ServiceInstance) bool {
+	sorted := slices.Clone(ins)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.revision != 0 && len(Diff(s.instances, sorted)) == 0 {
+		return false
+	}
+	s.instances = sorted
+	s.revision++
+	close(s.notify)
+	s.notify = make(chan struct{})
+	return true
+}
+
+// Load返回当前的revision与快照,以及在下一次更新时会被关闭的channel
+func (s *SnapshotStore) Load() (uint64, []*ServiceInstance, <-chan struct{}) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.revision, s.instances, s.notify
+}
+
+// Diff按照ID比较两个服务实例列表
+func Diff(old, cur []*ServiceInstance) []Event {
+	olds := make(map[string]*ServiceInstance, len(old))
+	for _, in := range old {
+		olds[in.ID] = in
+	}
+	var events []Event
+	for _, in := range cur {
+		o, ok := olds[in.ID]
+		switch {
+		case !ok:
+			events = append(events, Event{Type: EventAdded, Instance: in})
+		case !o.Equal(in):
+			events = append(events, Event{Type: EventUpdated, Instance: in})
+		}
+		delete(olds, in.ID)
+	}
+	for _, in := range old {
+		if _, ok := olds[in.ID]; ok {
+			events = append(events, Event{Type: EventRemoved, Instance: in})
+		}
+	}
+	return events
+}
+
+func (ins *ServiceInstance) Equal(o *ServiceInstance) bool {
+	if ins.ID != o.ID || ins.Name != o.Name || ins.Version != o.Version ||
+		!maps.Equal(ins.Metadata, o.Metadata) || len(ins.Endpoints) != len(o.Endpoints) {
+		return false
+	}
+	for i := range ins.Endpoints {
+		if ins.Endpoints[i].String() != o.Endpoints[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// SnapshotListener是基于SnapshotStore的通用Listener实现,各注册中心只需要维护SnapshotStore即可
+type SnapshotListener struct {
+	store    *SnapshotStore
+	selector *Selector
+	//该监听器上一次返回的revision与快照
+	revision uint64
+	last     []*ServiceInstance
+	lock     sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   func()
+	once   sync.Once
+}
+
+// ctx结束时监听器随之结束,selector为nil时不进行过滤,onStop会在StopListen时被调用且只调用一次,可以为nil
+func NewSnapshotListener(ctx context.Context, store *SnapshotStore, selector *Selector, onStop func()) *SnapshotListener {
+	l := &SnapshotListener{store: store, selector: selector, stop: onStop}
+	l.ctx, l.cancel = context.WithCancel(ctx)
+	return l
+}
+
+// 第一次调用或者服务发生变化时返回完整的服务实例列表,否则阻塞直至服务发生变化或监听器被关闭
+func (l *SnapshotListener) ListenAndGet(ctx context.Context) ([]*ServiceInstance, error) {
+	up, err := l.next(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return up.Instances, nil
+}
+
+func (l *SnapshotListener) ListenEvents(ctx context.Context) (*Update, error) {
+	return l.next(ctx, true)
+}
+
+func (l *SnapshotListener) next(ctx context.Context, withEvents bool) (*Update, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for {
+		rev, ins, notify := l.store.Load()
+		if rev > l.revision {
+			ins = l.selector.Filter(ins)
+			events := Diff(l.last, ins)
+			first := l.revision == 0
+			l.revision, l.last = rev, ins
+			//被过滤掉的实例发生变化时不需要唤醒该监听器
+			if first || len(events) > 0 {
+				up := &Update{Revision: rev, Instances: slices.Clone(ins)}
+				if withEvents {
+					up.Events = events
+				}
+				return up, nil
+			}
+			continue
+		}
+		select {
+		case <-l.ctx.Done():
+			return nil, l.ctx.Err()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+func (l *SnapshotListener) StopListen(_ context.Context) error {
+	l.cancel()
+	l.once.Do(func() {
+		if l.stop != nil {
+			l.stop()
+		}
+	})
+	return nil
+}
@@ -2,11 +2,11 @@ package consul
 
 import (
 	"context"
-	"fmt"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/hkensame/goken/pkg/dstruct/queue"
 	"github.com/hkensame/goken/pkg/log"
 	"github.com/hkensame/goken/registry"
 
@@ -18,7 +18,7 @@ type discover struct {
 	cli *api.Client
 	//缓存记录被加入监听的服务信息
 	mapServices map[string]*serviceInfo
-	lock        sync.RWMutex
+	lock        sync.Mutex
 	//服务发现中发现,更新服务信息的周期,默认为短轮询
 	ttl time.Duration
 
@@ -48,61 +48,74 @@ func MustNewConsulDiscover(cli *api.Client, options ...DiscoverOption) *discover
 	return d
 }
 
-// 为指定服务名称创建一个服务监听器,服务监听器会定时push服务的最新信息
-func (d *discover) NewListener(ctx context.Context, serviceName string) (registry.Listener, error) {
+// 为指定服务名称创建一个服务监听器,同一个服务的所有监听器共享一份快照与一个轮询协程
+// selector中的Tags交由consul在服务端过滤,相同tags的监听器共享一份快照,version与metadata则在每个监听器中过滤
+func (d *discover) NewListener(ctx context.Context, serviceName string, selector *registry.Selector) (registry.Listener, error) {
+	if err := selector.Validate(); err != nil {
+		return nil, err
+	}
+	var tags []string
+	if selector != nil {
+		tags = slices.Clone(selector.Tags)
+		slices.Sort(tags)
+		//tags已经在服务端过滤过,监听器中只需再过滤version与metadata
+		selector = &registry.Selector{Version: selector.Version, Metadata: selector.Metadata}
+	}
+	key := serviceName + "?" + strings.Join(tags, ",")
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
 	// 在缓存中中查找服务实例集合
-	service, ok := d.mapServices[serviceName]
+	service, ok := d.mapServices[key]
 	// 如果缓存不存在,就从Consul或其他服务注册中心加载服务信息
 	if !ok {
 		service = &serviceInfo{
-			listener: make(map[*listener]struct{}),
-			//services:    queue.Queue[],
-			serviceName:  serviceName,
-			serviceQueue: queue.NewQueue[*registry.ServiceInstance](),
+			key:         key,
+			serviceName: serviceName,
+			tags:        tags,
+			store:       registry.NewSnapshotStore(),
 		}
-		d.mapServices[serviceName] = service
-	}
-
-	l := &listener{
-		event: make(chan struct{}, 1),
+		//轮询协程的生命周期与该服务的所有监听器绑定,而不是与第一个监听器的ctx绑定
+		service.ctx, service.cancel = context.WithCancel(context.Background())
+		// 这里是真正调用consul-api的函数
+		if err := d.discover(service.ctx, service); err != nil {
+			service.cancel()
+			return nil, err
+		}
+		d.mapServices[key] = service
 	}
-	// 继承父context并且自己再产生一个cancel用于调控
-	l.ctx, l.cancel = context.WithCancel(ctx)
+	service.listeners++
 
-	// 关联监听器和service结构体
-	l.serivce = service
-	service.lock.Lock()
-	service.listener[l] = struct{}{}
-	service.lock.Unlock()
-	if service.serviceQueue.Length() > 0 {
-		//l.event <- struct{}{}
-		// 如果服务实例集合中有新数据则唤醒listener
-		service.storeAndAwake(nil)
-	}
+	return registry.NewSnapshotListener(ctx, service.store, selector, func() {
+		d.removeListener(service)
+	}), nil
+}
 
-	// 这里是真正调用consul-api的函数
-	if err := d.discover(ctx, service); err != nil {
-		return nil, err
+// 服务不再有监听器时停止轮询
+func (d *discover) removeListener(s *serviceInfo) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s.listeners--
+	if s.listeners == 0 && d.mapServices[s.key] == s {
+		s.cancel()
+		delete(d.mapServices, s.key)
 	}
-
-	return l, nil
 }
 
 // 启动对consul服务发现的轮询,需保证每一个service有且只调用一次这个函数
 func (d *discover) discover(ctx context.Context, ss *serviceInfo) error {
+	if d.dc == MultiDC {
+		return d.discoverMultiDC(ctx, ss)
+	}
 	//初始index设为0,以此获取最新服务数据
-	services, idx, err := d.DiscoverService(ctx, ss.serviceName, 0, true)
+	services, idx, err := d.DiscoverService(ctx, ss.serviceName, 0, true, ss.tags...)
 	if err != nil {
 		return err
 	}
 
-	//叫醒所有消费者
-	if len(services) > 0 {
-		ss.storeAndAwake(services)
-	}
+	//即使服务当前没有实例也需要存入,监听器据此得知服务的初始状态
+	ss.store.Store(services)
 	//这里开始定时检查更新consul服务信息,上面部分则是调用刚开始时立马查询更新一次
 	go func() {
 		ticker := time.NewTicker(d.ttl)
@@ -111,16 +124,16 @@ func (d *discover) discover(ctx context.Context, ss *serviceInfo) error {
 			select {
 			case <-ticker.C:
 				//用idx进行监听,监听逻辑在此
-				tmpService, tmpIdx, err := d.DiscoverService(ctx, ss.serviceName, idx, true)
+				tmpService, tmpIdx, err := d.DiscoverService(ctx, ss.serviceName, idx, true, ss.tags...)
 				if err != nil {
 					log.Errorf("[consul discover] 轮询中发现服务失败 err= %v", err)
 					//注意这里出了错并没检验是什么错
 					time.Sleep(time.Second)
 					continue
 				}
-				if len(tmpService) != 0 && tmpIdx != idx {
-					services = tmpService
-					ss.storeAndAwake(services)
+				//实例全部下线时同样需要通知监听器
+				if tmpIdx != idx {
+					ss.store.Store(tmpService)
 				}
 				idx = tmpIdx
 			case <-ctx.Done():
@@ -133,9 +146,10 @@ func (d *discover) discover(ctx context.Context, ss *serviceInfo) error {
 }
 
 // 从sonsul中发现发生改变的服务信息
-func (d *discover) DiscoverService(ctx context.Context, serviceName string, index uint64, passingOnly bool) ([]*registry.ServiceInstance, uint64, error) {
+// tags不为空时只返回带有所有这些tag的服务
+func (d *discover) DiscoverService(ctx context.Context, serviceName string, index uint64, passingOnly bool, tags ...string) ([]*registry.ServiceInstance, uint64, error) {
 	if d.dc == MultiDC {
-		return d.multiDCService(ctx, serviceName, index, passingOnly)
+		return d.multiDCService(ctx, serviceName, index, passingOnly, tags)
 	}
 
 	opts := &api.QueryOptions{
@@ -143,65 +157,29 @@ func (d *discover) DiscoverService(ctx context.Context, serviceName string, inde
 		//都会生成一个递增的Index,WaitIndex的作用是告知Consul客户端从哪个索引开始阻塞查询,客户端会等待直到当前索引变更,或者超时发生
 		WaitIndex:  index,
 		WaitTime:   time.Second * 55,
-		Datacenter: "", //d.dc,
+		Datacenter: d.datacenter(),
 		//强制保证多节点数据一致性
 		//RequireConsistent: true,
 	}
 	opts = opts.WithContext(ctx)
 
-	// if d.dc == SingleDC {
-	// 	opts.Datacenter = "dc1"
-	// }
-
-	entries, meta, err := d.singleDCEntries(serviceName, "", passingOnly, opts)
+	entries, meta, err := d.singleDCEntries(serviceName, tags, passingOnly, opts)
 	if err != nil {
 		return nil, 0, err
 	}
 	return d.serviceResolver(ctx, entries), meta.LastIndex, nil
 }
 
-func (d *discover) multiDCService(ctx context.Context, service string, index uint64, passingOnly bool) ([]*registry.ServiceInstance, uint64, error) {
-	if ctx == nil {
-		fmt.Println(service, index, passingOnly)
-	}
-	// 	opts := &api.QueryOptions{
-	// 		WaitIndex: index,
-	// 		WaitTime:  time.Second * 55,
-	// 	}
-	// 	opts = opts.WithContext(ctx)
-
-	// 	var instances []*registry.ServiceInstance
-
-	// 	dcs, err := d.cli.Catalog().Datacenters()
-	// 	if err != nil {
-	// 		return nil, 0, err
-	// 	}
-
-	// 	for _, dc := range dcs {
-	// 		opts.Datacenter = dc
-	// 		e, m, err := d.singleDCEntries(service, "", passingOnly, opts)
-	// 		if err != nil {
-	// 			return nil, 0, err
-	// 		}
-
-	// 		ins := d.resolver(ctx, e)
-	// 		for _, in := range ins {
-	// 			if in.Metadata == nil {
-	// 				in.Metadata = make(map[string]string, 1)
-	// 			}
-	// 			in.Metadata["dc"] = dc
-	// 		}
-
-	// 		instances = append(instances, ins...)
-	// 		opts.WaitIndex = m.LastIndex
-	// 	}
-
-	// return instances, opts.WaitIndex, nil
-	return nil, 0, nil
+func (d *discover) singleDCEntries(service string, tags []string, passingOnly bool, opts *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	return d.cli.Health().ServiceMultipleTags(service, tags, passingOnly, opts)
 }
 
-func (d *discover) singleDCEntries(service, tag string, passingOnly bool, opts *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
-	return d.cli.Health().Service(service, tag, passingOnly, opts)
+// SingleDC模式下使用consul agent所在的数据中心,否则dc即为要查询的数据中心名
+func (d *discover) datacenter() string {
+	if d.dc == SingleDC {
+		return ""
+	}
+	return d.dc
 }
 
 func (d *discover) RegisrtyName() string {
@@ -210,35 +188,23 @@ func (d *discover) RegisrtyName() string {
 
 // 对被注册到consul的服务的抽象
 type serviceInfo struct {
+	//mapServices中的key,由服务名与tags组成
+	key string
 	//服务名称
 	serviceName string
-	//监听器集合,若serviceInfo发生变化(对应的consul服务发生变化),可通过这些listener通知监听程序
-	listener map[*listener]struct{}
-	//还没被消费掉的Service信息
-	//services []*registry.ServiceInstance
-	serviceQueue *queue.Queue[*registry.ServiceInstance]
-
-	lock sync.RWMutex
-}
-
-// 把服务数据存入到serviceInfo中并唤醒所有消费者
-func (s *serviceInfo) storeAndAwake(ss []*registry.ServiceInstance) {
-	for _, service := range ss {
-		s.serviceQueue.Push(service)
-	}
-
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	for k := range s.listener {
-		select {
-		//广播唤醒所有消费者(类似于生产了每个消费者所需的信息)
-		case k.event <- struct{}{}:
-		default:
-		}
-	}
+	//在consul服务端过滤的tags
+	tags []string
+	//服务的最新快照,所有监听器从中读取,互不影响
+	store *registry.SnapshotStore
+	//监听器的数量,受discover.lock保护
+	listeners int
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-// 示例的选项函数
+// dc可以为SingleDC,MultiDC或者一个具体的数据中心名
+// MultiDC模式下会发现所有数据中心的服务并优先使用本地数据中心的实例,本地没有可用实例时才使用远端实例
 func WithDataCenter(dc string) DiscoverOption {
 	return func(d *discover) {
 		d.dc = dc
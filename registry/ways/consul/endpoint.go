@@ -0,0 +1,111 @@
+package consul
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hkensame/goken/registry"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// 完整的endpoint(包括权重,zone,TLS等属性)以url字符串的形式保存在Meta中,key为该前缀加上序号,
+// TaggedAddresses只用于在consul ui等工具中展示,无法携带endpoint的属性
+const metaEndpointPrefix = "goken_endpoint_"
+
+// consul自动生成的TaggedAddresses,不属于服务自己注册的endpoint
+func isConsulTaggedAddress(key string) bool {
+	return strings.HasPrefix(key, "lan_") || strings.HasPrefix(key, "wan_") || key == "lan" || key == "wan"
+}
+
+// encodeEndpoints返回写入了endpoints的Meta以及TaggedAddresses,
+// 同一协议的多个endpoint在TaggedAddresses中以grpc,grpc_1,grpc_2的形式区分,不会相互覆盖
+func encodeEndpoints(ins *registry.ServiceInstance) (map[string]string, map[string]api.ServiceAddress) {
+	meta := make(map[string]string, len(ins.Metadata)+len(ins.Endpoints))
+	for k, v := range ins.Metadata {
+		meta[k] = v
+	}
+	tagged := make(map[string]api.ServiceAddress, len(ins.Endpoints))
+	counts := make(map[string]int)
+	i := 0
+	for _, u := range ins.Endpoints {
+		if u == nil {
+			continue
+		}
+		//保存原始的url字符串,与ServiceInstance的json编码一致
+		meta[metaEndpointPrefix+strconv.Itoa(i)] = u.String()
+		i++
+
+		e := registry.ParseEndpoint(u)
+		host, portStr, err := net.SplitHostPort(e.Address)
+		if err != nil {
+			continue
+		}
+		port, _ := strconv.Atoi(portStr)
+		key := e.Protocol
+		if n := counts[e.Protocol]; n > 0 {
+			key += "_" + strconv.Itoa(n)
+		}
+		counts[e.Protocol]++
+		tagged[key] = api.ServiceAddress{Address: host, Port: port}
+	}
+	return meta, tagged
+}
+
+// decodeEndpoints从consul的服务信息中还原endpoints与业务metadata,
+// 兼容没有在Meta中保存endpoint的老版本注册信息
+func decodeEndpoints(s *api.AgentService) ([]*url.URL, map[string]string) {
+	md := make(map[string]string, len(s.Meta))
+	type indexed struct {
+		i int
+		u *url.URL
+	}
+	var list []indexed
+	for k, v := range s.Meta {
+		if idx, ok := strings.CutPrefix(k, metaEndpointPrefix); ok {
+			i, err := strconv.Atoi(idx)
+			u, perr := url.Parse(v)
+			if err == nil && perr == nil {
+				list = append(list, indexed{i: i, u: u})
+				continue
+			}
+		}
+		md[k] = v
+	}
+	if len(list) > 0 {
+		sort.Slice(list, func(a, b int) bool { return list[a].i < list[b].i })
+		endpoints := make([]*url.URL, 0, len(list))
+		for _, e := range list {
+			endpoints = append(endpoints, e.u)
+		}
+		return endpoints, md
+	}
+
+	endpoints := make([]*url.URL, 0)
+	keys := make([]string, 0, len(s.TaggedAddresses))
+	for k := range s.TaggedAddresses {
+		if !isConsulTaggedAddress(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		addr := s.TaggedAddresses[k]
+		scheme, _, _ := strings.Cut(k, "_")
+		endpoints = append(endpoints, &url.URL{
+			Scheme: scheme,
+			Host:   net.JoinHostPort(addr.Address, strconv.Itoa(addr.Port)),
+		})
+	}
+	//如果TaggedAddresses内无有效已注册服务地址就使用Address里的地址
+	if len(endpoints) == 0 && s.Address != "" && s.Port != 0 {
+		endpoints = append(endpoints, &url.URL{
+			Scheme: registry.ProtocolHTTP,
+			Host:   net.JoinHostPort(s.Address, strconv.Itoa(s.Port)),
+		})
+	}
+	return endpoints, md
+}
@@ -0,0 +1,69 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/hkensame/goken/registry"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// etcd与file注册中心使用ServiceInstance的json编码,其中的endpoint需要与consul保存在Meta中的完全一致
+func TestEndpointEncodingMatchesJSON(t *testing.T) {
+	raw := []string{
+		"grpc://127.0.0.1:9000",
+		"grpc://127.0.0.1:9001?zone=a&weight=10",
+		"grpcs://10.0.0.1:9000?tls=true",
+		"http://10.0.0.1:8080?tls=1&unknown=x",
+		"http://10.0.0.1:8080/api/v1?b=2&a=1",
+	}
+	ins := &registry.ServiceInstance{ID: "demo-1", Name: "demo", Version: "v1", Metadata: map[string]string{"k": "v"}}
+	for _, r := range raw {
+		u, err := url.Parse(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ins.Endpoints = append(ins.Endpoints, u)
+	}
+
+	data, err := json.Marshal(ins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encoded struct {
+		Endpoints []string `json:"endpoints"`
+	}
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := encodeEndpoints(ins)
+	if len(encoded.Endpoints) != len(raw) {
+		t.Fatalf("endpoint数量不一致 json = %v", encoded.Endpoints)
+	}
+	for i, e := range encoded.Endpoints {
+		//编码不能丢失path与未知的query参数
+		if e != raw[i] {
+			t.Fatalf("第%d个endpoint编码后有损 raw = %s, json = %s", i, raw[i], e)
+		}
+		if m := meta[metaEndpointPrefix+strconv.Itoa(i)]; m != e {
+			t.Fatalf("第%d个endpoint不一致 json = %s, consul = %s", i, e, m)
+		}
+	}
+
+	fromJSON := &registry.ServiceInstance{}
+	if err := json.Unmarshal(data, fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	endpoints, md := decodeEndpoints(&api.AgentService{Meta: meta})
+	if md["k"] != fromJSON.Metadata["k"] || len(md) != len(fromJSON.Metadata) {
+		t.Fatalf("metadata不一致 json = %v, consul = %v", fromJSON.Metadata, md)
+	}
+	for i, u := range endpoints {
+		if u.String() != fromJSON.Endpoints[i].String() {
+			t.Fatalf("第%d个endpoint解码后不一致 json = %s, consul = %s", i, fromJSON.Endpoints[i], u)
+		}
+	}
+}
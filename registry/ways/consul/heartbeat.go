@@ -0,0 +1,106 @@
+package consul
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hkensame/goken/pkg/errors"
+	"github.com/hkensame/goken/pkg/log"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// 一个服务实例的心跳协程
+type heartbeat struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func checkID(serviceID string) string {
+	return "service:" + serviceID
+}
+
+// startHeartbeat为服务实例启动心跳协程,同一个服务重复注册时会替换掉旧的心跳
+func (r *registor) startHeartbeat(asr *api.AgentServiceRegistration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	hb := &heartbeat{cancel: cancel, done: make(chan struct{})}
+
+	r.lock.Lock()
+	old := r.heartbeats[asr.ID]
+	r.heartbeats[asr.ID] = hb
+	r.lock.Unlock()
+	if old != nil {
+		old.cancel()
+		<-old.done
+	}
+	go r.heartbeatLoop(ctx, hb, asr)
+}
+
+func (r *registor) stopHeartbeat(serviceID string) {
+	r.lock.Lock()
+	hb := r.heartbeats[serviceID]
+	delete(r.heartbeats, serviceID)
+	r.lock.Unlock()
+	if hb != nil {
+		hb.cancel()
+		<-hb.done
+	}
+}
+
+// heartbeatLoop以ttl一半的周期向consul汇报服务健康,
+// 如果consul不认识该服务(例如consul agent重启后丢失了注册信息)就重新注册
+func (r *registor) heartbeatLoop(ctx context.Context, hb *heartbeat, asr *api.AgentServiceRegistration) {
+	defer close(hb.done)
+
+	ttl, _ := time.ParseDuration(r.ttlTimeout)
+	interval := ttl / 2
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		r.updateTTL(ctx, asr)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *registor) updateTTL(ctx context.Context, asr *api.AgentServiceRegistration) {
+	q := new(api.QueryOptions).WithContext(ctx)
+	err := r.cli.Agent().UpdateTTLOpts(checkID(asr.ID), "pass", api.HealthPassing, q)
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	if !isUnknownCheck(err) {
+		log.Errorf("[consul] 服务%s更新心跳失败 err = %v", asr.ID, err)
+		return
+	}
+
+	log.Warnf("[consul] consul中不存在服务%s,尝试重新注册 err = %v", asr.ID, err)
+	if err := r.cli.Agent().ServiceRegisterOpts(asr, api.ServiceRegisterOpts{}.WithContext(ctx)); err != nil {
+		log.Errorf("[consul] 服务%s重新注册失败 err = %v", asr.ID, err)
+		return
+	}
+	if err := r.cli.Agent().UpdateTTLOpts(checkID(asr.ID), "pass", api.HealthPassing, q); err != nil {
+		log.Errorf("[consul] 服务%s重新注册后更新心跳失败 err = %v", asr.ID, err)
+		return
+	}
+	log.Infof("[consul] 服务%s重新注册成功", asr.ID)
+}
+
+// consul对不存在的check返回404,老版本的agent则只在错误信息中说明
+func isUnknownCheck(err error) bool {
+	var se api.StatusError
+	if errors.As(err, &se) && se.Code == http.StatusNotFound {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "Unknown check") || strings.Contains(msg, "Unknown service")
+}
@@ -0,0 +1,215 @@
+package consul
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hkensame/goken/pkg/log"
+	"github.com/hkensame/goken/registry"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// 多数据中心模式下写入到ServiceInstance.Metadata中的数据中心标识
+const MetadataDC = "dc"
+
+// 多数据中心模式下重新获取数据中心列表的周期
+const dcRefreshInterval = time.Minute
+
+// 记录一个服务在各个数据中心中的实例
+type multiDCState struct {
+	//本地数据中心,为空时所有数据中心都被视为远端数据中心
+	local string
+	dcs   map[string][]*registry.ServiceInstance
+	lock  sync.Mutex
+}
+
+func (m *multiDCState) set(dc string, ins []*registry.ServiceInstance) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dcs[dc] = ins
+}
+
+func (m *multiDCState) has(dc string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.dcs[dc]
+	return ok
+}
+
+// merge优先返回本地数据中心的实例,本地没有可用实例时才返回所有远端数据中心的实例
+func (m *multiDCState) merge() []*registry.ServiceInstance {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if local := m.dcs[m.local]; len(local) > 0 {
+		return local
+	}
+	dcs := make([]string, 0, len(m.dcs))
+	for dc := range m.dcs {
+		dcs = append(dcs, dc)
+	}
+	sort.Strings(dcs)
+	res := make([]*registry.ServiceInstance, 0)
+	for _, dc := range dcs {
+		res = append(res, m.dcs[dc]...)
+	}
+	return res
+}
+
+// localDC返回当前consul agent所在的数据中心
+func (d *discover) localDC() (string, error) {
+	self, err := d.cli.Agent().Self()
+	if err != nil {
+		return "", err
+	}
+	dc, _ := self["Config"]["Datacenter"].(string)
+	return dc, nil
+}
+
+// dcService从指定的数据中心中发现服务,并在每个实例的metadata中记录所在的数据中心
+func (d *discover) dcService(ctx context.Context, service, dc string, tags []string, index uint64, passingOnly bool) ([]*registry.ServiceInstance, uint64, error) {
+	opts := &api.QueryOptions{
+		WaitIndex:  index,
+		WaitTime:   time.Second * 55,
+		Datacenter: dc,
+	}
+	opts = opts.WithContext(ctx)
+	entries, meta, err := d.singleDCEntries(service, tags, passingOnly, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ins := d.serviceResolver(ctx, entries)
+	for _, in := range ins {
+		md := make(map[string]string, len(in.Metadata)+1)
+		for k, v := range in.Metadata {
+			md[k] = v
+		}
+		md[MetadataDC] = dc
+		in.Metadata = md
+	}
+	return ins, meta.LastIndex, nil
+}
+
+// 对所有数据中心进行一次非阻塞的查询,由于每个数据中心的index互不相关,index参数会被忽略,
+// 返回值中的index为各数据中心中最大的index,仅用于判断数据是否发生过变化
+func (d *discover) multiDCService(ctx context.Context, service string, _ uint64, passingOnly bool, tags []string) ([]*registry.ServiceInstance, uint64, error) {
+	dcs, err := d.cli.Catalog().Datacenters()
+	if err != nil {
+		return nil, 0, err
+	}
+	local, err := d.localDC()
+	if err != nil {
+		log.Warnf("[consul discover] 获取本地数据中心失败 err= %v", err)
+	}
+
+	state := &multiDCState{local: local, dcs: make(map[string][]*registry.ServiceInstance)}
+	var maxIdx uint64
+	for _, dc := range dcs {
+		ins, idx, err := d.dcService(ctx, service, dc, tags, 0, passingOnly)
+		if err != nil {
+			if err := d.dcFailed(dc, local, dcs, len(state.dcs), err); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		state.set(dc, ins)
+		maxIdx = max(maxIdx, idx)
+	}
+	return state.merge(), maxIdx, nil
+}
+
+// 启动多数据中心模式下的服务发现,每个数据中心使用各自的阻塞index独立轮询,
+// 任意一个数据中心发生变化时都会重新合并并唤醒所有消费者
+func (d *discover) discoverMultiDC(ctx context.Context, ss *serviceInfo) error {
+	local, err := d.localDC()
+	if err != nil {
+		log.Warnf("[consul discover] 获取本地数据中心失败,所有数据中心都将被视为远端 err= %v", err)
+	}
+	state := &multiDCState{local: local, dcs: make(map[string][]*registry.ServiceInstance)}
+
+	dcs, err := d.cli.Catalog().Datacenters()
+	if err != nil {
+		return err
+	}
+	idxs := make(map[string]uint64, len(dcs))
+	ok := 0
+	for _, dc := range dcs {
+		ins, idx, err := d.dcService(ctx, ss.serviceName, dc, ss.tags, 0, true)
+		if err != nil {
+			if err := d.dcFailed(dc, local, dcs, ok, err); err != nil {
+				return err
+			}
+			//失败的数据中心之后由watchDC从头开始轮询
+			ins, idx = nil, 0
+		} else {
+			ok++
+		}
+		state.set(dc, ins)
+		idxs[dc] = idx
+	}
+	ss.store.Store(state.merge())
+
+	for dc, idx := range idxs {
+		go d.watchDC(ctx, ss, state, dc, idx)
+	}
+	//定期检查是否有新加入的数据中心
+	go func() {
+		ticker := time.NewTicker(dcRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				dcs, err := d.cli.Catalog().Datacenters()
+				if err != nil {
+					log.Errorf("[consul discover] 获取数据中心列表失败 err= %v", err)
+					continue
+				}
+				for _, dc := range dcs {
+					if !state.has(dc) {
+						state.set(dc, nil)
+						go d.watchDC(ctx, ss, state, dc, 0)
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// dcFailed决定查询某个数据中心失败时是否继续,远端数据中心失败时只记录日志并跳过,
+// 本地数据中心失败时返回err,本地数据中心未知时只有所有数据中心都失败才返回err
+func (d *discover) dcFailed(dc, local string, dcs []string, succeeded int, err error) error {
+	if dc == local || (local == "" && dc == dcs[len(dcs)-1] && succeeded == 0) {
+		return err
+	}
+	log.Warnf("[consul discover] 查询远端数据中心%s失败,暂时跳过 err= %v", dc, err)
+	return nil
+}
+
+func (d *discover) watchDC(ctx context.Context, ss *serviceInfo, state *multiDCState, dc string, idx uint64) {
+	ticker := time.NewTicker(d.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ins, tmpIdx, err := d.dcService(ctx, ss.serviceName, dc, ss.tags, idx, true)
+			if err != nil {
+				log.Errorf("[consul discover] 轮询数据中心%s失败 err= %v", dc, err)
+				time.Sleep(time.Second)
+				continue
+			}
+			if tmpIdx != idx {
+				state.set(dc, ins)
+				ss.store.Store(state.merge())
+			}
+			idx = tmpIdx
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -3,8 +3,11 @@ package consul
 import (
 	"context"
 	"fmt"
-	"net/url"
+	"maps"
+	"net"
+	"slices"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/hkensame/goken/pkg/log"
@@ -26,6 +29,10 @@ type registor struct {
 	heartBeat         bool
 	enableHealthCheck bool
 	ttlTimeout        string
+
+	//每个开启了心跳的服务实例对应一个心跳协程
+	heartbeats map[string]*heartbeat
+	lock       sync.Mutex
 }
 
 type RegistorOption func(*registor)
@@ -40,6 +47,7 @@ func MustNewConsulRegistor(apiClient *api.Client, opts ...RegistorOption) *regis
 		enableHealthCheck:              true,
 		ttlTimeout:                     "5s",
 		heartBeat:                      false,
+		heartbeats:                     make(map[string]*heartbeat),
 	}
 
 	for _, o := range opts {
@@ -48,48 +56,63 @@ func MustNewConsulRegistor(apiClient *api.Client, opts ...RegistorOption) *regis
 	return r
 }
 
+// instanceTags把version与metadata写为consul的tag,每个metadata同时写入k与k=v两种形式,
+// 使consul在服务端过滤tag的结果与其它注册中心用Selector匹配metadata的结果一致
+func instanceTags(ins *registry.ServiceInstance) []string {
+	tags := []string{fmt.Sprintf("version=%s", ins.Version)}
+	for _, k := range slices.Sorted(maps.Keys(ins.Metadata)) {
+		tags = append(tags, k)
+		//version=x的tag只用于匹配Version
+		if k != "version" {
+			tags = append(tags, k+"="+ins.Metadata[k])
+		}
+	}
+	return tags
+}
+
 // 服务注册接口
 func (r *registor) Register(ctx context.Context, ins *registry.ServiceInstance) error {
-	//这里map的key是web应用层协议,后续consul注册也是通过协议名注册
-	addresses := make(map[string]api.ServiceAddress, len(ins.Endpoints))
-	//记录所有需要健康检查的URL
-	checkAddresses := make([]*url.URL, 0, len(ins.Endpoints))
-	//这里通过一系列操作用于记录对应的信息
-	for _, endpoint := range ins.Endpoints {
-		port, _ := strconv.ParseInt(endpoint.Port(), 10, 32)
-		checkAddresses = append(checkAddresses, endpoint)
-		addresses[endpoint.Scheme] = api.ServiceAddress{Address: endpoint.Hostname(), Port: int(port)}
-	}
+	//endpoints完整地保存在Meta中,TaggedAddresses中同一协议的多个地址不会相互覆盖
+	meta, addresses := encodeEndpoints(ins)
+	endpoints := ins.TypedEndpoints()
 	asr := &api.AgentServiceRegistration{
 		ID:   ins.ID,
 		Name: ins.Name,
-		Meta: ins.Metadata,
-		Tags: []string{fmt.Sprintf("version=%s", ins.Version)},
+		Meta: meta,
+		Tags: instanceTags(ins),
 		//TaggedAddresses 用于一次注册多个地址
 		TaggedAddresses: addresses,
 	}
 
 	//拿第一个地址做默认地址
-	if len(checkAddresses) > 0 {
-		asr.Address = checkAddresses[0].Hostname()
-		port, _ := strconv.ParseInt(checkAddresses[0].Port(), 10, 32)
-		asr.Port = int(port)
+	if len(endpoints) > 0 {
+		if host, port, err := net.SplitHostPort(endpoints[0].Address); err == nil {
+			asr.Address = host
+			asr.Port, _ = strconv.Atoi(port)
+		}
 	}
 
 	if r.enableHealthCheck {
-		for _, address := range checkAddresses {
-			switch address.Scheme {
-			case "grpc":
+		for _, e := range endpoints {
+			switch {
+			case e.IsGRPC():
 				asr.Checks = append(asr.Checks, &api.AgentServiceCheck{
-					GRPC:                           address.Host,
+					GRPC:                           e.Address,
+					GRPCUseTLS:                     e.TLS,
+					TLSSkipVerify:                  e.TLS,
 					Interval:                       r.healthcheckInterval,
 					DeregisterCriticalServiceAfter: r.deregisterCriticalServiceAfter,
 					Timeout:                        r.timeout,
 				})
 
-			case "http", "https":
+			case e.IsHTTP():
+				scheme := registry.ProtocolHTTP
+				if e.TLS {
+					scheme = registry.ProtocolHTTPS
+				}
 				asr.Checks = append(asr.Checks, &api.AgentServiceCheck{
-					HTTP:                           address.Host + "/health",
+					HTTP:                           scheme + "://" + e.Address + "/health",
+					TLSSkipVerify:                  e.TLS,
 					Interval:                       r.healthcheckInterval,
 					DeregisterCriticalServiceAfter: r.deregisterCriticalServiceAfter,
 					Timeout:                        r.timeout,
@@ -105,7 +128,7 @@ func (r *registor) Register(ctx context.Context, ins *registry.ServiceInstance)
 	//相比于上面的检查模式,TTL模式要求服务主动向consul发送请求来确定服务是健康的
 	if r.heartBeat {
 		asr.Checks = append(asr.Checks, &api.AgentServiceCheck{
-			CheckID:                        "service:" + ins.ID,
+			CheckID:                        checkID(ins.ID),
 			TTL:                            r.ttlTimeout,
 			DeregisterCriticalServiceAfter: r.deregisterCriticalServiceAfter,
 		})
@@ -116,69 +139,16 @@ func (r *registor) Register(ctx context.Context, ins *registry.ServiceInstance)
 		log.Errorf("[consul] 服务注册失败 err = %v", err)
 		return registry.ErrRegisterFailed
 	}
+	if r.heartBeat {
+		r.startHeartbeat(asr)
+	}
 	return nil
 }
 
-// func (r *registor) HeatBeat(ctx context.Context,ins *registry.ServiceInstance) {
-// 	// 在首次运行时稍微等待1秒钟,确保其他启动过程已完成
-// 	time.Sleep(time.Second)
-
-// 	// 初始化服务健康检查状态为pass,表示服务健康
-// 	err := r.cli.Agent().UpdateTTL("service:"+ins.ID, "pass", "pass")
-// 	if err != nil {
-// 		log.Errorf("Consul心跳检查机制初始化服务状态失败 err= %v", err)
-// 	}
-
-// 	// 创建一个定时器,根据healthcheckInterval来控制心跳更新的间隔
-// 	ttlTimeout, _ := time.ParseDuration(r.ttlTimeout)
-// 	ttlTimeout = ttlTimeout / 2
-// 	ticker := time.NewTicker(time.Second * time.Duration(ttlTimeout))
-// 	defer ticker.Stop() // 确保在函数退出时停止ticker,避免内存泄漏
-
-// 	// 启动一个死循环,不断检查心跳,并处理服务的健康检查更新
-// 	for {
-// 		select {
-// 		// 如果上下文已取消或超时,注销服务并退出
-// 		case <-ctx.Done():
-// 			_ = r.cli.Agent().ServiceDeregister(ins.ID)
-// 			return
-// 		// 如果ticker时间到,更新TTL心跳
-// 		case <-ticker.C:
-// 			// 一层保险,如果上下文已被取消或者超时,注销服务并退出
-// 			if errors.Is(ctx.Err(), context.Canceled) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
-// 				_ = r.cli.Agent().ServiceDeregister(ins.ID)
-// 				return
-// 			}
-
-// 			// 更新服务的 TTL(Time-To-Live)状态为pass
-// 			err = r.cli.Agent().UpdateTTLOpts("service:"+ins.ID, "pass", "pass", new(api.QueryOptions).WithContext(ctx))
-// 			//同样是一层保险
-// 			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-// 				// 如果上下文被取消或超时,注销服务并退出
-// 				_ = r.cli.Agent().ServiceDeregister(ins.ID)
-// 				return
-// 			}
-
-// 			// 如果更新TTL时发生了错误,尝试重新注册该服务
-// 			if err != nil {
-// 				log.Errorf("Consul心跳检查机制更新服务状态失败 err=%v", err)
-
-// 				// 如果更新失败,稍微等待一下,然后尝试重新注册服务
-// 				time.Sleep(time.Duration(rand.Intn(5)) * time.Second)
-
-// 				// 重新注册服务
-// 				if err := r.cli.Agent().ServiceRegister(asr); err != nil {
-// 					log.Errorf("Consul心跳检查机制重新注册失败 err=%v", err)
-// 				} else {
-// 					log.Warn("Consul心跳检查机制重新注册成功")
-// 				}
-// 			}
-// 		}
-// 	}
-// }
-
 // 移除服务中心的服务
 func (r *registor) Deregister(ctx context.Context, serviceID string) error {
+	//先停止心跳,避免心跳协程在注销后又把服务重新注册回去
+	r.stopHeartbeat(serviceID)
 	if err := r.cli.Agent().ServiceDeregister(serviceID); err != nil {
 		log.Errorf("[consul] 服务注销失败 err = %v", err)
 		return registry.ErrDeregisterFailed
@@ -0,0 +1,20 @@
+package consul
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/hkensame/goken/registry"
+)
+
+// consul在服务端按tag过滤实例,结果需要与其它注册中心使用Selector匹配的结果一致
+func TestInstanceTagsMatchSelector(t *testing.T) {
+	ins := &registry.ServiceInstance{ID: "demo-1", Name: "demo", Version: "v1", Metadata: map[string]string{"zone": "a", "canary": ""}}
+	tags := instanceTags(ins)
+	for _, tag := range []string{"zone", "zone=a", "zone=b", "canary", "canary=", "version=v1", "version=v2", "version", "region", "region=a"} {
+		want := (&registry.Selector{Tags: []string{tag}}).Match(ins)
+		if got := slices.Contains(tags, tag); got != want {
+			t.Fatalf("tag = %s, consul = %v, selector = %v", tag, got, want)
+		}
+	}
+}
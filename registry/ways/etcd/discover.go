@@ -0,0 +1,215 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/hkensame/goken/pkg/log"
+	"github.com/hkensame/goken/registry"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type discover struct {
+	cli       *clientv3.Client
+	namespace string
+	//每次请求etcd的超时时间
+	timeout time.Duration
+
+	//缓存记录被加入监听的服务信息
+	mapServices map[string]*serviceInfo
+	lock        sync.Mutex
+}
+
+type DiscoverOption func(d *discover)
+
+func MustNewEtcdDiscover(cli *clientv3.Client, opts ...DiscoverOption) *discover {
+	d := &discover{
+		cli:         cli,
+		namespace:   defaultNamespace,
+		timeout:     time.Second * 5,
+		mapServices: make(map[string]*serviceInfo),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// 为指定服务名称创建一个服务监听器,同一个服务的所有监听器共享一份快照与一个etcd watch,
+// etcd中没有tag的概念,selector在每个监听器中过滤
+func (d *discover) NewListener(ctx context.Context, serviceName string, selector *registry.Selector) (registry.Listener, error) {
+	if err := selector.Validate(); err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	service, ok := d.mapServices[serviceName]
+	if !ok {
+		service = &serviceInfo{
+			d:           d,
+			serviceName: serviceName,
+			prefix:      serviceKey(d.namespace, serviceName, "") + "/",
+			instances:   make(map[string]*registry.ServiceInstance),
+			store:       registry.NewSnapshotStore(),
+		}
+		//先同步拉取一次全量数据,之后从该revision开始watch
+		if err := service.load(ctx); err != nil {
+			return nil, err
+		}
+		service.ctx, service.cancel = context.WithCancel(context.Background())
+		d.mapServices[serviceName] = service
+		go service.watch()
+	}
+	service.listeners++
+
+	return registry.NewSnapshotListener(ctx, service.store, selector, func() {
+		d.removeListener(service)
+	}), nil
+}
+
+func (d *discover) RegisrtyName() string {
+	return "etcd"
+}
+
+// 服务不再有监听器时停止对应的watch
+func (d *discover) removeListener(s *serviceInfo) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s.listeners--
+	if s.listeners == 0 && d.mapServices[s.serviceName] == s {
+		s.cancel()
+		delete(d.mapServices, s.serviceName)
+	}
+}
+
+// 对被注册到etcd的服务的抽象
+type serviceInfo struct {
+	d           *discover
+	serviceName string
+	prefix      string
+
+	//key为服务在etcd中的key
+	instances map[string]*registry.ServiceInstance
+	//已经同步到的etcd revision,watch中断后从revision+1处恢复
+	revision int64
+	lock     sync.Mutex
+	//服务的最新快照,所有监听器从中读取
+	store *registry.SnapshotStore
+	//监听器的数量,受discover.lock保护
+	listeners int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// load从etcd中拉取服务的全量数据并替换掉本地缓存
+func (s *serviceInfo) load(ctx context.Context) error {
+	tctx, cancel := context.WithTimeout(ctx, s.d.timeout)
+	defer cancel()
+	resp, err := s.d.cli.Get(tctx, s.prefix, clientv3.WithPrefix())
+	if err != nil {
+		log.Errorf("[etcd discover] 获取服务%s失败 err = %v", s.serviceName, err)
+		return err
+	}
+
+	instances := make(map[string]*registry.ServiceInstance, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		if ins := decodeInstance(kv); ins != nil {
+			instances[string(kv.Key)] = ins
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.instances = instances
+	s.revision = resp.Header.Revision
+	s.store.Store(s.list())
+	return nil
+}
+
+func decodeInstance(kv *mvccpb.KeyValue) *registry.ServiceInstance {
+	ins := &registry.ServiceInstance{}
+	if err := json.Unmarshal(kv.Value, ins); err != nil {
+		log.Errorf("[etcd discover] 解析服务%s失败 err = %v", kv.Key, err)
+		return nil
+	}
+	return ins
+}
+
+// watch持续监听服务的变化,中断后从上次同步到的revision处恢复,
+// 如果该revision已经被etcd压缩则重新拉取全量数据
+func (s *serviceInfo) watch() {
+	for {
+		s.lock.Lock()
+		rev := s.revision
+		s.lock.Unlock()
+
+		wch := s.d.cli.Watch(clientv3.WithRequireLeader(s.ctx), s.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+		for resp := range wch {
+			if resp.CompactRevision != 0 {
+				log.Warnf("[etcd discover] 服务%s的revision %d已被压缩,重新拉取全量数据", s.serviceName, rev+1)
+				s.load(s.ctx)
+				break
+			}
+			if err := resp.Err(); err != nil {
+				log.Errorf("[etcd discover] 监听服务%s失败 err = %v", s.serviceName, err)
+				break
+			}
+			s.apply(resp.Events, resp.Header.Revision)
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *serviceInfo) apply(events []*clientv3.Event, revision int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, ev := range events {
+		key := string(ev.Kv.Key)
+		switch ev.Type {
+		case clientv3.EventTypePut:
+			if ins := decodeInstance(ev.Kv); ins != nil {
+				s.instances[key] = ins
+			}
+		case clientv3.EventTypeDelete:
+			delete(s.instances, key)
+		}
+	}
+	s.revision = revision
+	if len(events) > 0 {
+		s.store.Store(s.list())
+	}
+}
+
+// list返回当前所有服务实例,调用者需持有s.lock
+func (s *serviceInfo) list() []*registry.ServiceInstance {
+	res := make([]*registry.ServiceInstance, 0, len(s.instances))
+	for _, ins := range s.instances {
+		res = append(res, ins)
+	}
+	return res
+}
+
+// 设置服务在etcd中的key前缀,需要与registor中的设置保持一致
+func WithDiscoverNamespace(namespace string) DiscoverOption {
+	return func(d *discover) {
+		d.namespace = namespace
+	}
+}
+
+// 设置每次请求etcd的超时时间
+func WithDiscoverTimeout(timeout time.Duration) DiscoverOption {
+	return func(d *discover) {
+		d.timeout = timeout
+	}
+}
@@ -0,0 +1,218 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hkensame/goken/registry"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// startEtcd启动一个单节点的内嵌etcd并返回连接它的client
+func startEtcd(t *testing.T) *clientv3.Client {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	cu, pu := freeURL(t), freeURL(t)
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{cu}, []url.URL{cu}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{pu}, []url.URL{pu}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(time.Second * 10):
+		t.Fatal("etcd启动超时")
+	}
+
+	cli, err := clientv3.New(clientv3.Config{Endpoints: []string{cu.String()}, DialTimeout: time.Second * 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+func freeURL(t *testing.T) url.URL {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return url.URL{Scheme: "http", Host: lis.Addr().String()}
+}
+
+func newInstance(id string) *registry.ServiceInstance {
+	u, _ := url.Parse(fmt.Sprintf("grpc://127.0.0.1:9000?weight=%d", len(id)))
+	return &registry.ServiceInstance{
+		ID:        id,
+		Name:      "demo",
+		Version:   "v1",
+		Metadata:  map[string]string{"zone": "a"},
+		Endpoints: []*url.URL{u},
+	}
+}
+
+// waitFor等待监听器返回满足cond的快照
+func waitFor(t *testing.T, l registry.Listener, cond func([]*registry.ServiceInstance) bool) []*registry.ServiceInstance {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		ins, err := l.ListenAndGet(ctx)
+		cancel()
+		if err == nil && cond(ins) {
+			return ins
+		}
+	}
+	t.Fatal("等待服务实例变化超时")
+	return nil
+}
+
+func TestRegisterDeregister(t *testing.T) {
+	cli := startEtcd(t)
+	ctx := context.Background()
+	r := MustNewEtcdRegistor(cli, WithLeaseTTL(time.Second*5))
+	d := MustNewEtcdDiscover(cli)
+
+	l, err := d.NewListener(ctx, "demo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.StopListen(ctx)
+	waitFor(t, l, func(ins []*registry.ServiceInstance) bool { return len(ins) == 0 })
+
+	want := newInstance("demo-1")
+	if err := r.Register(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	got := waitFor(t, l, func(ins []*registry.ServiceInstance) bool { return len(ins) == 1 })[0]
+	if got.ID != want.ID || got.Version != want.Version || got.Metadata["zone"] != "a" ||
+		len(got.Endpoints) != 1 || got.Endpoints[0].String() != want.Endpoints[0].String() {
+		t.Fatalf("服务实例不一致 got = %+v", got)
+	}
+
+	if err := r.Deregister(ctx, want.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, l, func(ins []*registry.ServiceInstance) bool { return len(ins) == 0 })
+	resp, err := cli.Get(ctx, serviceKey(defaultNamespace, "demo", want.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 0 {
+		t.Fatal("注销后key仍然存在")
+	}
+	if err := r.Deregister(ctx, want.ID); err == nil {
+		t.Fatal("重复注销应当失败")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	cli := startEtcd(t)
+	ctx := context.Background()
+	r := MustNewEtcdRegistor(cli, WithLeaseTTL(time.Second*2))
+	ins := newInstance("demo-1")
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(ctx, ins.ID)
+	key := serviceKey(defaultNamespace, ins.Name, ins.ID)
+
+	//超过租约有效期后依然存在说明续约在正常进行
+	time.Sleep(time.Second * 4)
+	resp, err := cli.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 {
+		t.Fatal("续约期间key不应过期")
+	}
+
+	//租约丢失后续约协程应当重新创建租约并写回服务信息
+	if _, err := cli.Revoke(ctx, clientv3.LeaseID(resp.Kvs[0].Lease)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		resp, err := cli.Get(ctx, key)
+		if err == nil && len(resp.Kvs) == 1 && resp.Kvs[0].Lease != 0 {
+			return
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+	t.Fatal("租约丢失后没有重新注册")
+}
+
+func TestWatchResume(t *testing.T) {
+	cli := startEtcd(t)
+	ctx := context.Background()
+	d := MustNewEtcdDiscover(cli)
+	r := MustNewEtcdRegistor(cli, WithLeaseTTL(time.Second*5))
+
+	if err := r.Register(ctx, newInstance("demo-1")); err != nil {
+		t.Fatal(err)
+	}
+	s := &serviceInfo{
+		d:           d,
+		serviceName: "demo",
+		prefix:      serviceKey(defaultNamespace, "demo", "") + "/",
+		instances:   make(map[string]*registry.ServiceInstance),
+		store:       registry.NewSnapshotStore(),
+	}
+	if err := s.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	//watch开始之前发生的变化应当从load得到的revision处补齐
+	if err := r.Register(ctx, newInstance("demo-2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Deregister(ctx, "demo-1"); err != nil {
+		t.Fatal(err)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.watch()
+		close(done)
+	}()
+
+	l := registry.NewSnapshotListener(ctx, s.store, nil, nil)
+	got := waitFor(t, l, func(ins []*registry.ServiceInstance) bool { return len(ins) == 1 && ins[0].ID == "demo-2" })
+	if got[0].Name != "demo" {
+		t.Fatalf("服务实例不一致 got = %+v", got[0])
+	}
+
+	//revision被压缩后应当重新拉取全量数据
+	s.cancel()
+	<-done
+	if err := r.Register(ctx, newInstance("demo-3")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := cli.Get(ctx, "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Compact(ctx, resp.Header.Revision); err != nil {
+		t.Fatal(err)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	defer s.cancel()
+	go s.watch()
+	waitFor(t, l, func(ins []*registry.ServiceInstance) bool { return len(ins) == 2 })
+	r.Deregister(ctx, "demo-2")
+	r.Deregister(ctx, "demo-3")
+}
@@ -0,0 +1,217 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/hkensame/goken/pkg/log"
+	"github.com/hkensame/goken/registry"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// 服务在etcd中的key为 <namespace>/<服务名>/<服务id>,value为ServiceInstance的json
+const defaultNamespace = "/goken/services"
+
+type registor struct {
+	cli       *clientv3.Client
+	namespace string
+	//租约的有效期,服务进程异常退出后最多经过ttl时间就会从etcd中移除
+	ttl time.Duration
+	//每次请求etcd的超时时间
+	timeout time.Duration
+
+	//记录每个已注册服务的租约,用于Deregister时撤销
+	leases map[string]*lease
+	lock   sync.Mutex
+}
+
+// 一个服务实例对应的租约以及维持租约的协程
+type lease struct {
+	key    string
+	value  string
+	id     clientv3.LeaseID
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type RegistorOption func(*registor)
+
+// 与consul一致,由调用者自己传入etcd的client
+func MustNewEtcdRegistor(cli *clientv3.Client, opts ...RegistorOption) *registor {
+	r := &registor{
+		cli:       cli,
+		namespace: defaultNamespace,
+		ttl:       time.Second * 15,
+		timeout:   time.Second * 5,
+		leases:    make(map[string]*lease),
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	if r.ttl < time.Second {
+		panic("etcd租约的ttl不能小于1s")
+	}
+	return r
+}
+
+func serviceKey(namespace, name, id string) string {
+	return path.Join(namespace, name, id)
+}
+
+// 服务注册接口,会为每个服务实例创建一个租约并持续续约,重复注册相同id的服务会替换掉旧的租约
+func (r *registor) Register(ctx context.Context, ins *registry.ServiceInstance) error {
+	data, err := json.Marshal(ins)
+	if err != nil {
+		log.Errorf("[etcd] 服务序列化失败 err = %v", err)
+		return registry.ErrRegisterFailed
+	}
+	l := &lease{
+		key:   serviceKey(r.namespace, ins.Name, ins.ID),
+		value: string(data),
+		done:  make(chan struct{}),
+	}
+
+	//重复注册时先停止旧租约的续约,避免旧协程在重新注册时覆盖掉新写入的数据
+	r.lock.Lock()
+	old := r.leases[ins.ID]
+	delete(r.leases, ins.ID)
+	r.lock.Unlock()
+	if old != nil {
+		old.cancel()
+		<-old.done
+	}
+
+	if l.id, err = r.grantAndPut(ctx, l.key, l.value); err != nil {
+		log.Errorf("[etcd] 服务注册失败 err = %v", err)
+		return registry.ErrRegisterFailed
+	}
+	if old != nil {
+		//新的租约已经接管了key,撤销旧租约不会影响新写入的数据
+		if err := r.revoke(old); err != nil {
+			log.Warnf("[etcd] 撤销服务%s的旧租约失败 err = %v", ins.ID, err)
+		}
+	}
+
+	//续约协程不应随着Register的ctx结束而结束,只在Deregister时停止
+	kctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	r.lock.Lock()
+	r.leases[ins.ID] = l
+	r.lock.Unlock()
+	go r.keepAlive(kctx, l)
+	return nil
+}
+
+// grantAndPut创建一个新的租约并把服务信息绑定到该租约上
+func (r *registor) grantAndPut(ctx context.Context, key, value string) (clientv3.LeaseID, error) {
+	tctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	grant, err := r.cli.Grant(tctx, int64(r.ttl/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.cli.Put(tctx, key, value, clientv3.WithLease(grant.ID)); err != nil {
+		r.cli.Revoke(context.Background(), grant.ID)
+		return 0, err
+	}
+	return grant.ID, nil
+}
+
+// keepAlive持续为租约续约,一旦续约中断(如网络故障导致租约过期)就会重新创建租约并写入服务信息
+func (r *registor) keepAlive(ctx context.Context, l *lease) {
+	defer close(l.done)
+	for {
+		ch, err := r.cli.KeepAlive(ctx, l.id)
+		if err == nil {
+			for range ch {
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warnf("[etcd] 服务%s的租约续约中断,准备重新注册 err = %v", l.key, err)
+
+		backoff := time.Second
+		for {
+			//加入随机抖动,避免大量实例同时重新注册
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff + time.Duration(rand.Int63n(int64(backoff)))):
+			}
+			id, err := r.grantAndPut(ctx, l.key, l.value)
+			if err == nil {
+				l.id = id
+				log.Infof("[etcd] 服务%s重新注册成功", l.key)
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			log.Errorf("[etcd] 服务%s重新注册失败 err = %v", l.key, err)
+			if backoff < r.ttl {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+// 撤销租约会一并删除仍与之绑定的key,调用前需保证续约协程已经退出
+func (r *registor) revoke(l *lease) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	_, err := r.cli.Revoke(ctx, l.id)
+	return err
+}
+
+// 移除注册中心中的服务
+func (r *registor) Deregister(ctx context.Context, serviceID string) error {
+	r.lock.Lock()
+	l, ok := r.leases[serviceID]
+	delete(r.leases, serviceID)
+	r.lock.Unlock()
+	if !ok {
+		log.Warnf("[etcd] 服务%s未通过该注册器注册", serviceID)
+		return registry.ErrDeregisterFailed
+	}
+
+	l.cancel()
+	<-l.done
+	tctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	if _, err := r.cli.Delete(tctx, l.key); err != nil {
+		log.Errorf("[etcd] 服务注销失败 err = %v", err)
+		return registry.ErrDeregisterFailed
+	}
+	//key已经删除,租约撤销失败也只是等待其自然过期
+	if err := r.revoke(l); err != nil {
+		log.Warnf("[etcd] 撤销服务%s的租约失败 err = %v", serviceID, err)
+	}
+	return nil
+}
+
+// 设置服务在etcd中的key前缀,需要与discover中的设置保持一致
+func WithNamespace(namespace string) RegistorOption {
+	return func(r *registor) {
+		r.namespace = namespace
+	}
+}
+
+// 设置租约的有效期,最小为1s
+func WithLeaseTTL(ttl time.Duration) RegistorOption {
+	return func(r *registor) {
+		r.ttl = ttl
+	}
+}
+
+// 设置每次请求etcd的超时时间
+func WithTimeout(timeout time.Duration) RegistorOption {
+	return func(r *registor) {
+		r.timeout = timeout
+	}
+}
@@ -0,0 +1,244 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hkensame/goken/pkg/errors"
+	"github.com/hkensame/goken/pkg/log"
+	"github.com/hkensame/goken/registry"
+	"github.com/hkensame/goken/registry/ways/memory"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// Registry从一个YAML或JSON文件中读取服务实例列表,文件被修改后会自动重新加载,
+// 文件格式由后缀决定(.yaml/.yml为YAML,其余为JSON),内容为ServiceInstance的列表,例如:
+//
+//   - id: user-1
+//     name: user
+//     version: v1
+//     metadata: {zone: a}
+//     endpoints: [grpc://127.0.0.1:9000]
+//
+// Register与Deregister会把修改写回到文件中,因此多个进程可以通过同一个文件互相发现
+type Registry struct {
+	path string
+	yaml bool
+	//文件变化后等待debounce时间再重新加载,避免编辑器保存时的多次写入导致重复加载
+	debounce time.Duration
+
+	mem *memory.Registry
+	//串行化对文件的读写
+	lock    sync.Mutex
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+type OptionFunc func(*Registry)
+
+// 文件变化后等待d时间再重新加载,默认为100ms
+func WithDebounce(d time.Duration) OptionFunc {
+	return func(r *Registry) {
+		r.debounce = d
+	}
+}
+
+// 文件不存在时视为没有任何服务,首次Register时会创建该文件
+func MustNewFileRegistry(path string, opts ...OptionFunc) *Registry {
+	ext := strings.ToLower(filepath.Ext(path))
+	r := &Registry{
+		path:     path,
+		yaml:     ext == ".yaml" || ext == ".yml",
+		debounce: time.Millisecond * 100,
+		mem:      memory.MustNewMemoryRegistry(),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	ins, err := r.read()
+	if err != nil {
+		panic(err)
+	}
+	r.mem.Replace(ins)
+
+	if r.watcher, err = fsnotify.NewWatcher(); err != nil {
+		panic(err)
+	}
+	//监听文件所在的目录而不是文件本身,编辑器保存与原子替换都会导致文件本身的watch失效
+	if err := r.watcher.Add(filepath.Dir(path)); err != nil {
+		panic(err)
+	}
+	go r.watch()
+	return r
+}
+
+func (r *Registry) Register(ctx context.Context, ins *registry.ServiceInstance) error {
+	return r.modify(func(list []*registry.ServiceInstance) ([]*registry.ServiceInstance, error) {
+		if ins == nil || ins.ID == "" || ins.Name == "" {
+			return nil, errors.New("服务的id与name不能为空")
+		}
+		for i, in := range list {
+			if in.ID == ins.ID {
+				list[i] = ins
+				return list, nil
+			}
+		}
+		return append(list, ins), nil
+	}, registry.ErrRegisterFailed)
+}
+
+func (r *Registry) Deregister(ctx context.Context, serviceID string) error {
+	return r.modify(func(list []*registry.ServiceInstance) ([]*registry.ServiceInstance, error) {
+		for i, in := range list {
+			if in.ID == serviceID {
+				return append(list[:i], list[i+1:]...), nil
+			}
+		}
+		return nil, errors.Errorf("服务%s不存在", serviceID)
+	}, registry.ErrDeregisterFailed)
+}
+
+// modify以文件中最新的内容为准进行修改并写回,随后立即更新内存中的数据而不必等待文件变化的通知
+func (r *Registry) modify(fn func([]*registry.ServiceInstance) ([]*registry.ServiceInstance, error), failed error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	list, err := r.read()
+	if err == nil {
+		list, err = fn(list)
+	}
+	if err == nil {
+		err = r.write(list)
+	}
+	if err != nil {
+		log.Errorf("[file registry] 修改文件%s失败 err = %v", r.path, err)
+		return failed
+	}
+	r.mem.Replace(list)
+	return nil
+}
+
+func (r *Registry) NewListener(ctx context.Context, serviceName string, selector *registry.Selector) (registry.Listener, error) {
+	return r.mem.NewListener(ctx, serviceName, selector)
+}
+
+func (r *Registry) RegisrtyName() string {
+	return "file"
+}
+
+// 停止监听文件的变化
+func (r *Registry) Close() error {
+	select {
+	case <-r.done:
+		return nil
+	default:
+	}
+	close(r.done)
+	return r.watcher.Close()
+}
+
+func (r *Registry) watch() {
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-r.done:
+			return
+		case ev, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(ev.Name) != filepath.Clean(r.path) {
+				continue
+			}
+			timer = time.After(r.debounce)
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("[file registry] 监听文件%s失败 err = %v", r.path, err)
+		case <-timer:
+			timer = nil
+			r.reload()
+		}
+	}
+}
+
+func (r *Registry) reload() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ins, err := r.read()
+	if err != nil {
+		//文件内容有误时保留上一次成功加载的数据
+		log.Errorf("[file registry] 重新加载文件%s失败 err = %v", r.path, err)
+		return
+	}
+	r.mem.Replace(ins)
+	log.Infof("[file registry] 重新加载文件%s,共%d个服务实例", r.path, len(ins))
+}
+
+func (r *Registry) read() ([]*registry.ServiceInstance, error) {
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return nil, nil
+	}
+
+	//YAML先转为JSON,从而与其它注册中心使用相同的ServiceInstance编码
+	if r.yaml {
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, errors.Wrapf(err, "解析文件%s失败", r.path)
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return nil, errors.Wrapf(err, "解析文件%s失败", r.path)
+		}
+	}
+	var ins []*registry.ServiceInstance
+	if err := json.Unmarshal(data, &ins); err != nil {
+		return nil, errors.Wrapf(err, "解析文件%s失败", r.path)
+	}
+	return ins, nil
+}
+
+// write先写入临时文件再替换,保证其它进程读到的总是完整的内容
+func (r *Registry) write(ins []*registry.ServiceInstance) error {
+	if ins == nil {
+		ins = []*registry.ServiceInstance{}
+	}
+	data, err := json.MarshalIndent(ins, "", "  ")
+	if err != nil {
+		return err
+	}
+	if r.yaml {
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		if data, err = yaml.Marshal(v); err != nil {
+			return err
+		}
+	}
+
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package memory
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/hkensame/goken/pkg/log"
+	"github.com/hkensame/goken/registry"
+)
+
+// Registry把服务实例保存在进程内存中,同时实现了registry.Registor与registry.Discover,
+// 适用于本地运行与单元测试,注册后同一进程中的监听器可以立即感知到变化
+type Registry struct {
+	//key为服务id
+	instances map[string]*registry.ServiceInstance
+	//key为服务名,每个被监听过的服务对应一份快照
+	stores map[string]*registry.SnapshotStore
+	lock   sync.Mutex
+}
+
+var defaultRegistry = MustNewMemoryRegistry()
+
+// Default返回进程级别共享的Registry,不同组件无需互相传递即可通过它注册与发现服务
+func Default() *Registry {
+	return defaultRegistry
+}
+
+// 创建一个独立的Registry,与Default()返回的Registry互不影响,一般用于测试间的隔离
+func MustNewMemoryRegistry() *Registry {
+	return &Registry{
+		instances: make(map[string]*registry.ServiceInstance),
+		stores:    make(map[string]*registry.SnapshotStore),
+	}
+}
+
+// 注册服务实例,相同id的实例会被替换
+func (r *Registry) Register(_ context.Context, ins *registry.ServiceInstance) error {
+	if ins == nil || ins.ID == "" || ins.Name == "" {
+		log.Errorf("[memory] 服务注册失败,服务的id与name不能为空")
+		return registry.ErrRegisterFailed
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	old := r.instances[ins.ID]
+	r.instances[ins.ID] = clone(ins)
+	if old != nil && old.Name != ins.Name {
+		r.publish(old.Name)
+	}
+	r.publish(ins.Name)
+	return nil
+}
+
+func (r *Registry) Deregister(_ context.Context, serviceID string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	old, ok := r.instances[serviceID]
+	if !ok {
+		log.Warnf("[memory] 服务%s不存在", serviceID)
+		return registry.ErrDeregisterFailed
+	}
+	delete(r.instances, serviceID)
+	r.publish(old.Name)
+	return nil
+}
+
+// Replace用ins替换掉Registry中所有的服务实例,并通知发生了变化的服务的监听器
+func (r *Registry) Replace(ins []*registry.ServiceInstance) {
+	instances := make(map[string]*registry.ServiceInstance, len(ins))
+	for _, in := range ins {
+		if in == nil || in.ID == "" || in.Name == "" {
+			log.Warnf("[memory] 忽略id或name为空的服务实例 %v", in)
+			continue
+		}
+		instances[in.ID] = clone(in)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.instances = instances
+	//快照没有变化的服务不会产生新的revision
+	for name := range r.stores {
+		r.publish(name)
+	}
+}
+
+// List返回所有服务实例,按照id排序
+func (r *Registry) List() []*registry.ServiceInstance {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	res := make([]*registry.ServiceInstance, 0, len(r.instances))
+	for _, id := range slices.Sorted(maps.Keys(r.instances)) {
+		res = append(res, clone(r.instances[id]))
+	}
+	return res
+}
+
+func (r *Registry) NewListener(ctx context.Context, serviceName string, selector *registry.Selector) (registry.Listener, error) {
+	if err := selector.Validate(); err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	store, ok := r.stores[serviceName]
+	if !ok {
+		store = registry.NewSnapshotStore()
+		r.stores[serviceName] = store
+		r.publish(serviceName)
+	}
+	return registry.NewSnapshotListener(ctx, store, selector, nil), nil
+}
+
+func (r *Registry) RegisrtyName() string {
+	return "memory"
+}
+
+// publish把服务当前的实例列表存入快照,调用者需持有r.lock
+func (r *Registry) publish(serviceName string) {
+	store, ok := r.stores[serviceName]
+	if !ok {
+		return
+	}
+	ins := make([]*registry.ServiceInstance, 0)
+	for _, in := range r.instances {
+		if in.Name == serviceName {
+			ins = append(ins, in)
+		}
+	}
+	store.Store(ins)
+}
+
+// 快照中的实例会被所有监听器共享,因此存入前需要拷贝一份,避免调用者之后的修改影响到监听器
+func clone(ins *registry.ServiceInstance) *registry.ServiceInstance {
+	c := *ins
+	c.Metadata = maps.Clone(ins.Metadata)
+	c.Endpoints = slices.Clone(ins.Endpoints)
+	return &c
+}
@@ -0,0 +1,64 @@
+package jwt
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+type claimsCtxKey struct{}
+type tokenCtxKey struct{}
+
+// 携带Authorization值的前缀
+const BearerPrefix = "Bearer "
+
+// NewContext把认证通过的claims与原始token存入ctx,供后续的handler读取以及向下游服务转发
+func NewContext(ctx context.Context, claims jwt.MapClaims, token string) context.Context {
+	ctx = context.WithValue(ctx, claimsCtxKey{}, claims)
+	return context.WithValue(ctx, tokenCtxKey{}, token)
+}
+
+// ClaimsFromContext读取认证通过的claims,ctx可以是*gin.Context及其派生的ctx,也可以是它的Request.Context()
+func ClaimsFromContext(ctx context.Context) (jwt.MapClaims, bool) {
+	if claims, ok := ctx.Value(claimsCtxKey{}).(jwt.MapClaims); ok {
+		return claims, true
+	}
+	if c := ginContext(ctx); c != nil {
+		if v, ok := c.Get(JwtClaimsKey); ok {
+			claims, ok := v.(jwt.MapClaims)
+			return claims, ok
+		}
+	}
+	return nil, false
+}
+
+// TokenFromContext读取认证通过的原始token(不含Bearer前缀)
+func TokenFromContext(ctx context.Context) (string, bool) {
+	if token, ok := ctx.Value(tokenCtxKey{}).(string); ok && token != "" {
+		return token, true
+	}
+	if c := ginContext(ctx); c != nil && c.Request != nil {
+		token, ok := c.Request.Context().Value(tokenCtxKey{}).(string)
+		return token, ok && token != ""
+	}
+	return "", false
+}
+
+// ginContext从ctx中找到*gin.Context,ctx可以是由*gin.Context派生出的ctx
+func ginContext(ctx context.Context) *gin.Context {
+	if c, ok := ctx.(*gin.Context); ok {
+		return c
+	}
+	c, _ := ctx.Value(gin.ContextKey).(*gin.Context)
+	return c
+}
+
+// TrimBearer去掉token的Bearer前缀
+func TrimBearer(token string) string {
+	if len(token) > len(BearerPrefix) && strings.EqualFold(token[:len(BearerPrefix)], BearerPrefix) {
+		return token[len(BearerPrefix):]
+	}
+	return token
+}
@@ -91,33 +91,44 @@ func (mw *GinJWTMiddleware) authAccessToken(c *gin.Context) error {
 		return err
 	}
 
-	tk, err := mw.parseTokenstr(tokenStr)
+	claims, err := mw.ValidateToken(tokenStr)
 	if err != nil {
 		return err
 	}
 
+	c.Set(JwtClaimsKey, claims)
+	c.Request = c.Request.WithContext(NewContext(c.Request.Context(), claims, TrimBearer(tokenStr)))
+	return nil
+}
+
+// ValidateToken校验token的签名,算法与过期时间并返回其中的claims,token可以带有Bearer前缀,
+// 不依赖gin.Context,因此rpc服务可以使用与http中间件相同的规则校验token
+func (mw *GinJWTMiddleware) ValidateToken(tokenStr string) (jwt.MapClaims, error) {
+	tk, err := mw.parseTokenstr(TrimBearer(tokenStr))
+	if err != nil {
+		return nil, err
+	}
+
 	claims, ok := tk.Claims.(jwt.MapClaims)
 	if !ok {
-		return ErrInvalidToken
+		return nil, ErrInvalidToken
 	}
 
 	switch v := claims[ExpKey].(type) {
 	case nil:
-		return ErrInvalidToken
+		return nil, ErrInvalidToken
 	case float64:
 		if v < float64(mw.TimeFunc().Unix()) {
-			return ErrExpiredToken
+			return nil, ErrExpiredToken
 		}
 	case int64:
 		if v < mw.TimeFunc().Unix() {
-			return ErrExpiredToken
+			return nil, ErrExpiredToken
 		}
 	default:
-		return ErrInvalidToken
+		return nil, ErrInvalidToken
 	}
-
-	c.Set(JwtClaimsKey, claims)
-	return nil
+	return claims, nil
 }
 
 // 返回新的access_token或者错误
@@ -168,6 +179,7 @@ func (mw *GinJWTMiddleware) authRefreshToken(c *gin.Context) (string, error) {
 
 	c.Header(AccessTokenKey, acctk)
 	c.Set(JwtClaimsKey, claims)
+	c.Request = c.Request.WithContext(NewContext(c.Request.Context(), claims, acctk))
 	return acctk, nil
 
 }
@@ -2,6 +2,7 @@ package httpserver
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/hkensame/goken/registry"
 	"github.com/hkensame/goken/server/httpserver/middlewares/jwt"
@@ -13,21 +14,29 @@ import (
 
 type ServerOption func(*Server)
 
+// 使用ins作为该服务的实例,多个服务(如同一进程中的http与grpc服务)传入同一个ins时会把各自的endpoint加入其中,
+// 由app合并注册为一个实例,WithServiceName等选项会作用在ins上
+func WithServiceInstance(ins *registry.ServiceInstance) ServerOption {
+	return func(s *Server) {
+		s.Instance = ins
+	}
+}
+
 func WithServiceName(serviceName string) ServerOption {
 	return func(s *Server) {
-		s.Instance.Name = serviceName
+		s.insOpts = append(s.insOpts, func(ins *registry.ServiceInstance) { ins.Name = serviceName })
 	}
 }
 
 func WithServiceID(id string) ServerOption {
 	return func(s *Server) {
-		s.Instance.ID = id
+		s.insOpts = append(s.insOpts, func(ins *registry.ServiceInstance) { ins.ID = id })
 	}
 }
 
 func WithServiceVersion(v string) ServerOption {
 	return func(s *Server) {
-		s.Instance.Version = v
+		s.insOpts = append(s.insOpts, func(ins *registry.ServiceInstance) { ins.Version = v })
 	}
 }
 
@@ -92,3 +101,17 @@ func WithGrpcClient(target string, opts ...rpcserver.ClientOption) ServerOption
 		s.GrpcCli = rpcserver.MustNewClient(s.Ctx, target, opts...)
 	}
 }
+
+// 注销服务后等待d时间再停止接收请求,给注册中心与客户端留出感知服务下线的时间
+func WithDrainDelay(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.DrainDelay = d
+	}
+}
+
+// 停止服务时等待进行中的请求完成的最长时间
+func WithStopTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.StopTimeout = d
+	}
+}
@@ -5,13 +5,14 @@ import (
 	//"github.com/penglongli/gin-metrics/ginmetrics"
 
 	"context"
-	"fmt"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/hkensame/goken/registry"
 	"github.com/hkensame/goken/server/httpserver/middlewares/jwt"
@@ -58,9 +59,24 @@ type Server struct {
 	Locale string
 
 	Instance *registry.ServiceInstance
+	//WithServiceName等修改实例的选项,在确定Instance后统一应用,与WithServiceInstance的先后顺序无关
+	insOpts []func(*registry.ServiceInstance)
+	//注册使用的地址,在Listen中由实际监听的地址解析得到
+	endpoint string
 
 	Server *http.Server
+	//为nil时在Listen中使用Host创建
+	Lis    net.Listener
 	closed bool
+
+	//注销服务后等待注册中心与客户端感知到变化的时间,只在存在注册器时等待
+	DrainDelay time.Duration
+	//等待进行中的请求完成的最长时间,超时后强制关闭所有连接
+	StopTimeout time.Duration
+	//为true时/health返回503
+	draining  atomic.Bool
+	drainOnce sync.Once
+	drainErr  error
 }
 
 func MustNewServer(ctx context.Context, host string, opts ...ServerOption) *Server {
@@ -76,15 +92,23 @@ func MustNewServer(ctx context.Context, host string, opts ...ServerOption) *Serv
 		InSecure:        true,
 		Server:          &http.Server{},
 		UseAbort:        true,
+		DrainDelay:      time.Second * 3,
+		StopTimeout:     time.Second * 10,
 	}
 
-	s.Instance = &registry.ServiceInstance{
-		Name: host,
-		ID:   host,
-	}
+	s.Instance = new(registry.ServiceInstance)
 	for _, o := range opts {
 		o(s)
 	}
+	for _, o := range s.insOpts {
+		o(s.Instance)
+	}
+	if s.Instance.ID == "" {
+		s.Instance.ID = host
+	}
+	if s.Instance.Name == "" {
+		s.Instance.Name = host
+	}
 	if len(s.Middlewares) == 0 {
 		mws.CopyDefaultMiddlewares(s.Middlewares)
 	}
@@ -96,27 +120,15 @@ func MustNewServer(ctx context.Context, host string, opts ...ServerOption) *Serv
 	s.Server.Addr = s.Host
 	s.Server.Handler = s.Engine
 	//无论如何都开启/health路径便于后续服务注册,健康检查
+	//下线过程中返回503,使健康检查尽快把该实例标记为不可用
 	s.Engine.GET("/health", func(ctx *gin.Context) {
+		if s.draining.Load() {
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{})
+			return
+		}
 		ctx.JSON(200, gin.H{})
 	})
 
-	//只有注册器存在才构造instance
-	if s.Registor != nil {
-		u, err := url.Parse(host)
-		if err != nil {
-			if s.InSecure {
-				host = fmt.Sprintf("http://%s", host)
-			} else {
-				host = fmt.Sprintf("https://%s", host)
-			}
-			u, err = url.Parse(host)
-			if err != nil {
-				panic(err)
-			}
-		}
-		s.Instance.Endpoints = append(s.Instance.Endpoints, u)
-	}
-
 	for _, m := range s.Middlewares {
 		s.Engine.Use(m)
 	}
@@ -158,6 +170,68 @@ func (s *Server) Deregister(ctx context.Context) error {
 	return nil
 }
 
+// Listen绑定监听地址并把可供访问的地址加入Instance的endpoints,重复调用时不会再次绑定
+func (s *Server) Listen() error {
+	if s.endpoint != "" {
+		return nil
+	}
+	if s.Lis == nil {
+		lis, err := net.Listen("tcp", s.Server.Addr)
+		if err != nil {
+			return err
+		}
+		s.Lis = lis
+	}
+	//监听0.0.0.0或端口为0时,使用网卡地址与实际分配的端口进行注册
+	addr, err := hostgen.ResolveHost(s.Lis.Addr().String())
+	if err != nil {
+		return err
+	}
+	if addr == "" {
+		addr = s.Lis.Addr().String()
+	}
+	s.endpoint = addr
+
+	protocol := registry.ProtocolHTTP
+	if !s.InSecure {
+		protocol = registry.ProtocolHTTPS
+	}
+	s.Instance.AddEndpoint(registry.Endpoint{Protocol: protocol, Address: s.endpoint})
+	return nil
+}
+
+// Run在Lis上接收请求,阻塞直到服务停止,不会注册服务也不会监听终止信号,一般由app调用
+func (s *Server) Run(ctx context.Context) error {
+	gin.SetMode(s.Mode)
+	log.Infof("[httpserver] 服务启动中,监听信息为: host = %s", s.Host)
+	if err := s.Validator.Excute(); err != nil {
+		return err
+	}
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	if err := s.Server.Serve(s.Lis); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// SetNotServing让/health返回503,但依然会正常处理请求,一般由app在注销服务前调用
+func (s *Server) SetNotServing() {
+	s.draining.Store(true)
+}
+
+// Shutdown让/health返回503并停止服务,与Drain不同的是不会注销服务,一般由统一管理服务注册的app调用
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.SetNotServing()
+	return s.stop(ctx)
+}
+
+// ServiceInstance返回需要注册到注册中心的服务实例
+func (s *Server) ServiceInstance() *registry.ServiceInstance {
+	return s.Instance
+}
+
 func (s *Server) Serve() error {
 	// 设置开发模式,打印路由信息格式
 	gin.SetMode(s.Mode)
@@ -171,6 +245,11 @@ func (s *Server) Serve() error {
 		return err
 	}
 
+	// 注册前绑定监听地址,endpoint需要使用实际监听的地址
+	if err := s.Listen(); err != nil {
+		return err
+	}
+
 	// 如果注册器为空就不进行注册,而不是返回错误
 	if err := s.Register(s.Ctx, s.Instance); err != nil && err != ErrNilHttpRegistor {
 		return err
@@ -180,31 +259,19 @@ func (s *Server) Serve() error {
 	sign := make(chan os.Signal, 1)
 	signal.Notify(sign, syscall.SIGTERM, syscall.SIGINT)
 
-	// 确保Deregister只执行一次
-	var deregisterOnce sync.Once
-	deregisterFunc := func() {
-		deregisterOnce.Do(func() {
-			if e := s.Deregister(s.Ctx); e != nil && e != ErrNilHttpRegistor {
-				log.Errorf("[httpserver] 服务注销失败, err= %v", e)
-			} else {
-				log.Info("[httpserver] 服务正常注销")
-			}
-		})
-	}
-
 	// 启动 HTTP 服务器
 	g.Add(
 		func() error {
-			if err := s.Server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			if err := s.Listen(); err != nil {
+				return err
+			}
+			if err := s.Server.Serve(s.Lis); err != nil && err != http.ErrServerClosed {
 				return err
 			}
 			return nil
 		},
 		func(err error) {
-			if e1 := s.Server.Shutdown(s.Ctx); e1 != nil {
-				log.Errorf("[httpserver] http根服务注销失败, err= %v", e1)
-			}
-			deregisterFunc()
+			s.Drain(context.Background())
 		},
 	)
 
@@ -212,12 +279,7 @@ func (s *Server) Serve() error {
 	g.Add(
 		func() error {
 			<-sign
-			if e1 := s.Server.Shutdown(s.Ctx); e1 != nil {
-				log.Errorf("[httpserver] 服务注销失败, err= %v", e1)
-				return e1
-			}
-			deregisterFunc()
-			return nil
+			return s.Drain(context.Background())
 		},
 		func(err error) {
 			select {
@@ -228,3 +290,56 @@ func (s *Server) Serve() error {
 	)
 	return g.Run()
 }
+
+// Drain按照以下顺序优雅下线服务,多次调用只会执行一次:
+//  1. /health返回503,依赖健康检查的负载均衡器不再把新请求路由过来
+//  2. 从注册中心注销服务
+//  3. 等待DrainDelay,让注册中心与客户端感知到服务下线
+//  4. 停止接收新请求并等待进行中的请求完成,超过StopTimeout后强制关闭
+func (s *Server) Drain(ctx context.Context) error {
+	s.drainOnce.Do(func() {
+		s.drainErr = s.drain(ctx)
+	})
+	return s.drainErr
+}
+
+func (s *Server) drain(ctx context.Context) error {
+	log.Infof("[httpserver] 服务开始下线, host = %s", s.Host)
+	s.SetNotServing()
+
+	var err error
+	if e := s.Deregister(ctx); e != nil && e != ErrNilHttpRegistor {
+		log.Errorf("[httpserver] 服务注销失败, err= %v", e)
+		err = e
+	} else if e == nil {
+		log.Info("[httpserver] 服务正常注销")
+		if s.DrainDelay > 0 {
+			select {
+			case <-time.After(s.DrainDelay):
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	if e := s.stop(ctx); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// stop停止接收新请求并等待进行中的请求完成,超过StopTimeout后强制关闭
+func (s *Server) stop(ctx context.Context) error {
+	sctx := ctx
+	if s.StopTimeout > 0 {
+		var cancel context.CancelFunc
+		sctx, cancel = context.WithTimeout(ctx, s.StopTimeout)
+		defer cancel()
+	}
+	if err := s.Server.Shutdown(sctx); err != nil {
+		log.Warnf("[httpserver] 等待进行中的请求失败,强制关闭服务, err= %v", err)
+		s.Server.Close()
+		return err
+	}
+	log.Info("[httpserver] 服务已停止")
+	return nil
+}
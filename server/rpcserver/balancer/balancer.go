@@ -0,0 +1,152 @@
+package balancer
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// goken提供的负载均衡器,通过服务实例的metadata(即resolver.Address.Attributes)进行调度,
+// 所有goken负载均衡器都会把选中的实例地址写入请求ctx中的pickutil.Picked
+const (
+	// 普通的轮询
+	RoundRobin = "goken_round_robin"
+	// 平滑加权轮询,权重取自metadata中的weight
+	WeightedRoundRobin = "goken_weighted_round_robin"
+	// 随机选出两个连接,使用其中未完成请求更少的那个(power of two choices)
+	P2C = "goken_p2c"
+	// 优先使用与客户端处于同一zone的实例,同zone内轮询,同zone没有可用实例时使用所有实例
+	ZoneAffinity = "goken_zone_affinity"
+	// 一致性哈希,哈希key取自请求metadata中的指定header,相同key的请求总是落在同一个实例上
+	RingHash = "goken_ring_hash"
+)
+
+// 服务实例metadata中被负载均衡器使用的key
+const (
+	MetadataWeight = "weight"
+	MetadataZone   = "zone"
+)
+
+// 默认的哈希header
+const DefaultHashHeader = "x-hash-key"
+
+// Config是通过service config中的loadBalancingConfig传给负载均衡器的配置
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	//ZoneAffinity使用,客户端所在的zone
+	Zone string `json:"zone,omitempty"`
+	//RingHash使用,从请求的outgoing metadata中读取哈希key的header
+	HashHeader string `json:"hashHeader,omitempty"`
+	//RingHash使用,每单位权重对应的虚拟节点数,单个实例的虚拟节点总数不超过4096
+	VirtualNodes int `json:"virtualNodes,omitempty"`
+}
+
+func init() {
+	register(RoundRobin, func() configurablePicker { return &rrPickerBuilder{} })
+	register(WeightedRoundRobin, func() configurablePicker { return &wrrPickerBuilder{} })
+	register(P2C, func() configurablePicker { return newP2CPickerBuilder() })
+	register(ZoneAffinity, func() configurablePicker { return &zonePickerBuilder{} })
+	register(RingHash, func() configurablePicker { return &ringHashPickerBuilder{} })
+}
+
+// ServiceConfig返回使用name负载均衡器的service config,可以直接传给grpc.WithDefaultServiceConfig
+func ServiceConfig(name string, cfg *Config) string {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	data, _ := json.Marshal([]map[string]*Config{{name: cfg}})
+	return `{"loadBalancingConfig": ` + string(data) + `}`
+}
+
+// configurablePicker是可以接收Config的base.PickerBuilder
+type configurablePicker interface {
+	base.PickerBuilder
+	setConfig(*Config)
+}
+
+// builder为每个ClientConn创建独立的PickerBuilder,从而让配置与连接的统计数据只在一个ClientConn内生效
+type builder struct {
+	name string
+	new  func() configurablePicker
+}
+
+func register(name string, new func() configurablePicker) {
+	balancer.Register(&builder{name: name, new: new})
+}
+
+func (b *builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := b.new()
+	pb.setConfig(&Config{})
+	return &configBalancer{
+		Balancer: base.NewBalancerBuilder(b.name, addrPickerBuilder{pb}, base.Config{HealthCheck: true}).Build(cc, opts),
+		pb:       pb,
+	}
+}
+
+func (b *builder) Name() string {
+	return b.name
+}
+
+func (b *builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	cfg := &Config{}
+	if err := json.Unmarshal(js, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configBalancer在把状态交给base balancer之前先更新picker的配置,
+// base balancer会在之后重新生成picker,因此新的配置能够立即生效
+type configBalancer struct {
+	balancer.Balancer
+	pb configurablePicker
+}
+
+func (b *configBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if cfg, ok := s.BalancerConfig.(*Config); ok {
+		b.pb.setConfig(cfg)
+	}
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// 各PickerBuilder共用的配置存取
+type configHolder struct {
+	cfg  *Config
+	lock sync.Mutex
+}
+
+func (h *configHolder) setConfig(cfg *Config) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.cfg = cfg
+}
+
+func (h *configHolder) config() *Config {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.cfg
+}
+
+// attribute读取resolver.Address.Attributes中的字符串值
+func attribute(a *attributes.Attributes, key string) string {
+	if a == nil {
+		return ""
+	}
+	v, _ := a.Value(key).(string)
+	return v
+}
+
+// weight读取实例的权重,没有设置或格式有误时为1,小于0时视为0
+func weight(a *attributes.Attributes) int {
+	w, err := strconv.Atoi(attribute(a, MetadataWeight))
+	if err != nil {
+		return 1
+	}
+	return max(w, 0)
+}
@@ -0,0 +1,73 @@
+package balancer
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+type p2cPickerBuilder struct {
+	configHolder
+	//每个连接上未完成的请求数,picker重建后依然保留,从而不会丢失正在进行中的请求
+	inflight map[balancer.SubConn]*atomic.Int64
+	lock     sync.Mutex
+}
+
+func newP2CPickerBuilder() *p2cPickerBuilder {
+	return &p2cPickerBuilder{inflight: make(map[balancer.SubConn]*atomic.Int64)}
+}
+
+func (b *p2cPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	items := make([]*p2cItem, 0, len(info.ReadySCs))
+	inflight := make(map[balancer.SubConn]*atomic.Int64, len(info.ReadySCs))
+	for sc := range info.ReadySCs {
+		n, ok := b.inflight[sc]
+		if !ok {
+			n = &atomic.Int64{}
+		}
+		inflight[sc] = n
+		items = append(items, &p2cItem{sc: sc, inflight: n})
+	}
+	//不再可用的连接无需继续统计
+	b.inflight = inflight
+	return &p2cPicker{items: items}
+}
+
+type p2cItem struct {
+	sc       balancer.SubConn
+	inflight *atomic.Int64
+}
+
+type p2cPicker struct {
+	items []*p2cItem
+}
+
+func (p *p2cPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	it := p.items[0]
+	if n := len(p.items); n > 1 {
+		i := rand.Intn(n)
+		j := rand.Intn(n - 1)
+		if j >= i {
+			j++
+		}
+		it = p.items[i]
+		if o := p.items[j]; o.inflight.Load() < it.inflight.Load() {
+			it = o
+		}
+	}
+	it.inflight.Add(1)
+	return balancer.PickResult{
+		SubConn: it.sc,
+		Done: func(balancer.DoneInfo) {
+			it.inflight.Add(-1)
+		},
+	}, nil
+}
@@ -0,0 +1,37 @@
+package balancer
+
+import (
+	"github.com/hkensame/goken/pkg/common/pickutil"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+// addrPickerBuilder为每个picker记录SubConn对应的地址,选中实例后写入请求ctx中的pickutil.Picked
+type addrPickerBuilder struct {
+	base.PickerBuilder
+}
+
+func (b addrPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	addrs := make(map[balancer.SubConn]string, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		addrs[sc] = sci.Address.Addr
+	}
+	return &addrPicker{Picker: b.PickerBuilder.Build(info), addrs: addrs}
+}
+
+type addrPicker struct {
+	balancer.Picker
+	addrs map[balancer.SubConn]string
+}
+
+func (p *addrPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	res, err := p.Picker.Pick(info)
+	if err != nil {
+		return res, err
+	}
+	if picked, ok := pickutil.FromContext(info.Ctx); ok {
+		picked.SetAddr(p.addrs[res.SubConn])
+	}
+	return res, nil
+}
@@ -0,0 +1,84 @@
+package balancer
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+
+	"github.com/spaolacci/murmur3"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+)
+
+// 每单位权重默认的虚拟节点数
+const defaultVirtualNodes = 100
+
+// 单个实例最多的虚拟节点数,权重取自注册中心的metadata,需要避免单个实例的过大权重让所有客户端构建巨大的哈希环
+const maxVirtualNodesPerHost = 4096
+
+type ringHashPickerBuilder struct {
+	configHolder
+}
+
+func (b *ringHashPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	cfg := b.config()
+	header := cfg.HashHeader
+	if header == "" {
+		header = DefaultHashHeader
+	}
+	vnodes := cfg.VirtualNodes
+	if vnodes <= 0 {
+		vnodes = defaultVirtualNodes
+	}
+	vnodes = min(vnodes, maxVirtualNodesPerHost)
+
+	p := &ringHashPicker{header: header}
+	for sc, sci := range info.ReadySCs {
+		p.scs = append(p.scs, sc)
+		//虚拟节点只由地址决定,因此实例的增减只会影响到它自己的那部分key
+		w := min(max(weight(sci.Address.Attributes), 1), maxVirtualNodesPerHost)
+		n := min(vnodes*w, maxVirtualNodesPerHost)
+		for i := 0; i < n; i++ {
+			p.ring = append(p.ring, ringNode{
+				hash: murmur3.Sum64([]byte(sci.Address.Addr + "#" + strconv.Itoa(i))),
+				sc:   sc,
+			})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+	return p
+}
+
+type ringNode struct {
+	hash uint64
+	sc   balancer.SubConn
+}
+
+type ringHashPicker struct {
+	header string
+	ring   []ringNode
+	scs    []balancer.SubConn
+}
+
+// 请求没有携带哈希header时随机选择一个实例
+func (p *ringHashPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	md, _ := metadata.FromOutgoingContext(info.Ctx)
+	keys := md.Get(p.header)
+	if len(keys) == 0 || keys[0] == "" {
+		return balancer.PickResult{SubConn: p.scs[rand.Intn(len(p.scs))]}, nil
+	}
+	h := murmur3.Sum64([]byte(keys[0]))
+	i := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+	if i == len(p.ring) {
+		i = 0
+	}
+	return balancer.PickResult{SubConn: p.ring[i].sc}, nil
+}
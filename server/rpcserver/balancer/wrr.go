@@ -0,0 +1,59 @@
+package balancer
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+type wrrPickerBuilder struct {
+	configHolder
+}
+
+func (b *wrrPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	items := make([]*wrrItem, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		if w := weight(sci.Address.Attributes); w > 0 {
+			items = append(items, &wrrItem{sc: sc, weight: w})
+		}
+	}
+	//所有实例的权重都为0时退化为普通的轮询
+	if len(items) == 0 {
+		for sc := range info.ReadySCs {
+			items = append(items, &wrrItem{sc: sc, weight: 1})
+		}
+	}
+	return &wrrPicker{items: items}
+}
+
+type wrrItem struct {
+	sc      balancer.SubConn
+	weight  int
+	current int
+}
+
+// 平滑加权轮询(与nginx相同),权重为5,1,1时的选择顺序为a,a,b,a,c,a,a,而不是a,a,a,a,a,b,c
+type wrrPicker struct {
+	items []*wrrItem
+	lock  sync.Mutex
+}
+
+func (p *wrrPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	total := 0
+	var best *wrrItem
+	for _, it := range p.items {
+		it.current += it.weight
+		total += it.weight
+		if best == nil || it.current > best.current {
+			best = it
+		}
+	}
+	best.current -= total
+	return balancer.PickResult{SubConn: best.sc}, nil
+}
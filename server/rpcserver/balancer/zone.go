@@ -0,0 +1,56 @@
+package balancer
+
+import (
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+type zonePickerBuilder struct {
+	configHolder
+}
+
+func (b *zonePickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	zone := b.config().Zone
+	local := make([]balancer.SubConn, 0)
+	all := make([]balancer.SubConn, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		all = append(all, sc)
+		if zone != "" && attribute(sci.Address.Attributes, MetadataZone) == zone {
+			local = append(local, sc)
+		}
+	}
+	if len(local) == 0 {
+		local = all
+	}
+	return &rrPicker{scs: local}
+}
+
+type rrPickerBuilder struct {
+	configHolder
+}
+
+func (b *rrPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	scs := make([]balancer.SubConn, 0, len(info.ReadySCs))
+	for sc := range info.ReadySCs {
+		scs = append(scs, sc)
+	}
+	return &rrPicker{scs: scs}
+}
+
+type rrPicker struct {
+	scs  []balancer.SubConn
+	next atomic.Uint32
+}
+
+func (p *rrPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	n := p.next.Add(1)
+	return balancer.PickResult{SubConn: p.scs[int(n)%len(p.scs)]}, nil
+}
@@ -0,0 +1,203 @@
+package cinterceptors
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hkensame/goken/pkg/log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type BreakerState int
+
+const (
+	// 正常放行请求
+	BreakerClosed BreakerState = iota
+	// 拒绝所有请求,OpenTimeout后进入半开状态
+	BreakerOpen
+	// 放行少量探测请求,探测成功后关闭,失败后重新打开
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// 熔断器打开时请求直接返回该错误而不会发出
+var ErrBreakerOpen = status.Error(codes.Unavailable, "熔断器已打开,请求被拒绝")
+
+// BreakerConfig是熔断器的配置,零值字段使用默认值
+type BreakerConfig struct {
+	//连续失败多少次后打开熔断器,默认为5
+	FailureThreshold int
+	//熔断器打开后多久进入半开状态,默认为10s
+	OpenTimeout time.Duration
+	//半开状态下放行的探测请求数,全部成功后关闭熔断器,默认为1
+	HalfOpenRequests int
+}
+
+func (c *BreakerConfig) withDefaults() BreakerConfig {
+	cfg := BreakerConfig{}
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 5
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = time.Second * 10
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	return cfg
+}
+
+// Breaker是一个三态(closed,open,half-open)熔断器
+type Breaker struct {
+	name string
+	cfg  BreakerConfig
+
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	//半开状态下已放行与已成功的探测请求数
+	probes    int
+	successes int
+	lock      sync.Mutex
+}
+
+func NewBreaker(name string, cfg *BreakerConfig) *Breaker {
+	return &Breaker{name: name, cfg: cfg.withDefaults()}
+}
+
+func (b *Breaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// Allow判断是否放行一个请求,放行的请求结束后必须调用Record
+func (b *Breaker) Allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cfg.OpenTimeout {
+			return ErrBreakerOpen
+		}
+		b.setState(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return ErrBreakerOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// Record记录一次请求的结果,只有体现服务端故障的状态码才被计为失败
+func (b *Breaker) Record(err error) {
+	failed := isBreakerFailure(err)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.cfg.FailureThreshold {
+			b.setState(BreakerOpen)
+		}
+	case BreakerHalfOpen:
+		if failed {
+			b.setState(BreakerOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenRequests {
+			b.setState(BreakerClosed)
+		}
+	}
+}
+
+// setState切换状态并重置统计数据,调用者需持有b.lock
+func (b *Breaker) setState(s BreakerState) {
+	if b.state != s {
+		log.Warnf("[rpcclient] 目标%s的熔断器由%s切换为%s", b.name, b.state, s)
+	}
+	b.state = s
+	b.failures, b.probes, b.successes = 0, 0, 0
+	if s == BreakerOpen {
+		b.openedAt = time.Now()
+	}
+}
+
+func isBreakerFailure(err error) bool {
+	switch GrpcCode(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.DataLoss, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// breakers为每个目标(ClientConn.Target())维护一个熔断器
+type breakers struct {
+	cfg  *BreakerConfig
+	m    map[string]*Breaker
+	lock sync.Mutex
+}
+
+func (bs *breakers) get(target string) *Breaker {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	b, ok := bs.m[target]
+	if !ok {
+		b = NewBreaker(target, bs.cfg)
+		bs.m[target] = b
+	}
+	return b
+}
+
+// UnaryBreakerInterceptor为每个目标维护一个熔断器,熔断器打开时直接返回ErrBreakerOpen
+func UnaryBreakerInterceptor(cfg *BreakerConfig) grpc.UnaryClientInterceptor {
+	bs := &breakers{cfg: cfg, m: make(map[string]*Breaker)}
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		b := bs.get(cc.Target())
+		if err := b.Allow(); err != nil {
+			return err
+		}
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		b.Record(err)
+		return err
+	}
+}
+
+// StreamBreakerInterceptor只统计流的建立是否成功
+func StreamBreakerInterceptor(cfg *BreakerConfig) grpc.StreamClientInterceptor {
+	bs := &breakers{cfg: cfg, m: make(map[string]*Breaker)}
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		b := bs.get(cc.Target())
+		if err := b.Allow(); err != nil {
+			return nil, err
+		}
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		b.Record(err)
+		return cs, err
+	}
+}
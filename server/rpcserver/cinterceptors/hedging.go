@@ -0,0 +1,110 @@
+package cinterceptors
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// HedgingConfig是对冲请求的配置,零值字段使用默认值
+type HedgingConfig struct {
+	//开启对冲的方法全名(如/user.User/GetUser),只应包含幂等的方法
+	Methods []string
+	//前一个请求发出后多久没有返回就发出下一个请求,默认为100ms
+	Delay time.Duration
+	//同一次调用最多发出的请求数,默认为2,最大为5
+	MaxAttempts int
+	//请求返回这些状态码时立即发出下一个请求而不是结束调用,默认为Unavailable
+	NonFatalCodes []codes.Code
+}
+
+func (c *HedgingConfig) withDefaults() HedgingConfig {
+	cfg := HedgingConfig{}
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.Delay <= 0 {
+		cfg.Delay = time.Millisecond * 100
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 2
+	}
+	cfg.MaxAttempts = min(cfg.MaxAttempts, 5)
+	if len(cfg.NonFatalCodes) == 0 {
+		cfg.NonFatalCodes = []codes.Code{codes.Unavailable}
+	}
+	return cfg
+}
+
+type hedgeResult struct {
+	reply proto.Message
+	err   error
+}
+
+// UnaryHedgingInterceptor对配置中的幂等方法发出对冲请求:第一个请求在Delay内没有返回时再发出一个,
+// 以最先返回的成功结果(或致命错误)为准,其余请求会被取消,从而降低长尾延迟.
+// 各请求共享调用者传入的CallOption,因此对冲方法不应使用grpc.Header,grpc.Peer等会写回数据的选项
+func UnaryHedgingInterceptor(c *HedgingConfig) grpc.UnaryClientInterceptor {
+	cfg := c.withDefaults()
+	methods := make(map[string]struct{}, len(cfg.Methods))
+	for _, m := range cfg.Methods {
+		methods[m] = struct{}{}
+	}
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		msg, ok := reply.(proto.Message)
+		if _, hedged := methods[method]; !hedged || !ok || cfg.MaxAttempts < 2 {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		results := make(chan hedgeResult, cfg.MaxAttempts)
+		started, pending := 0, 0
+		launch := func() {
+			r := msg.ProtoReflect().New().Interface()
+			started++
+			pending++
+			go func() {
+				results <- hedgeResult{reply: r, err: invoker(ctx, method, req, r, cc, opts...)}
+			}()
+		}
+
+		launch()
+		timer := time.NewTimer(cfg.Delay)
+		defer timer.Stop()
+		var lastErr error
+		for {
+			select {
+			case <-timer.C:
+				if started < cfg.MaxAttempts {
+					launch()
+					timer.Reset(cfg.Delay)
+				}
+			case res := <-results:
+				pending--
+				if res.err == nil {
+					proto.Reset(msg)
+					proto.Merge(msg, res.reply)
+					return nil
+				}
+				if !slices.Contains(cfg.NonFatalCodes, GrpcCode(res.err)) {
+					return res.err
+				}
+				lastErr = res.err
+				if started < cfg.MaxAttempts {
+					launch()
+					timer.Reset(cfg.Delay)
+				} else if pending == 0 {
+					return lastErr
+				}
+			case <-ctx.Done():
+				return status.FromContextError(ctx.Err()).Err()
+			}
+		}
+	}
+}
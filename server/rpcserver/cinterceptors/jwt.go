@@ -0,0 +1,42 @@
+package cinterceptors
+
+import (
+	"context"
+
+	kjwt "github.com/hkensame/goken/server/httpserver/middlewares/jwt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// 转发token时使用的metadata key,与服务端JWTAuth默认读取的header一致
+const AuthorizationHeader = "authorization"
+
+// forwardToken把ctx中的token写入outgoing metadata,token来源依次为:
+// 经过jwt中间件认证的gin请求(ctx为*gin.Context或其Request.Context()),经过JWTAuth认证的rpc请求的incoming metadata,
+// 调用者已经在outgoing metadata中设置了token时不做修改
+func forwardToken(ctx context.Context) context.Context {
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md.Get(AuthorizationHeader)) > 0 {
+		return ctx
+	}
+	token, ok := kjwt.TokenFromContext(ctx)
+	if !ok {
+		md, _ := metadata.FromIncomingContext(ctx)
+		vals := md.Get(AuthorizationHeader)
+		if len(vals) == 0 || vals[0] == "" {
+			return ctx
+		}
+		token = kjwt.TrimBearer(vals[0])
+	}
+	return metadata.AppendToOutgoingContext(ctx, AuthorizationHeader, kjwt.BearerPrefix+token)
+}
+
+// UnaryJWTForwardInterceptor把上游请求携带的token转发给下游的rpc服务
+func UnaryJWTForwardInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(forwardToken(ctx), method, req, reply, cc, opts...)
+}
+
+// StreamJWTForwardInterceptor把上游请求携带的token转发给下游的rpc服务
+func StreamJWTForwardInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(forwardToken(ctx), desc, cc, method, opts...)
+}
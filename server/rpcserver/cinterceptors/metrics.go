@@ -0,0 +1,102 @@
+package cinterceptors
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+)
+
+// rpc客户端的prometheus指标,在第一次使用metrics拦截器时注册到prometheus.DefaultRegisterer
+var (
+	clientHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goken",
+		Subsystem: "rpc_client",
+		Name:      "handled_total",
+		Help:      "rpc客户端完成的请求数",
+	}, []string{"method", "type", "code"})
+
+	clientHandlingSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "goken",
+		Subsystem: "rpc_client",
+		Name:      "handling_seconds",
+		Help:      "rpc客户端请求的耗时",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"method", "type"})
+
+	metricsOnce sync.Once
+)
+
+func registerMetrics() {
+	metricsOnce.Do(func() {
+		clientHandled = registerCollector(clientHandled)
+		clientHandlingSeconds = registerCollector(clientHandlingSeconds)
+	})
+}
+
+// registerCollector注册c,使用者提前注册过相同的指标时返回已经注册的那个
+func registerCollector[T prometheus.Collector](c T) T {
+	if err := prometheus.Register(c); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			panic(err)
+		}
+		existing, ok := are.ExistingCollector.(T)
+		if !ok {
+			panic(err)
+		}
+		return existing
+	}
+	return c
+}
+
+func observe(method string, kind string) func(error) {
+	registerMetrics()
+	start := time.Now()
+	return func(err error) {
+		clientHandled.WithLabelValues(method, kind, GrpcCode(err).String()).Inc()
+		clientHandlingSeconds.WithLabelValues(method, kind).Observe(time.Since(start).Seconds())
+	}
+}
+
+// UnaryMetricsInterceptor统计一元请求的数量,耗时与状态码,重试与对冲的多次请求只计为一次
+func UnaryMetricsInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	done := observe(method, "unary")
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	done(err)
+	return err
+}
+
+// StreamMetricsInterceptor统计流式请求,以流结束时的状态为准
+func StreamMetricsInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	done := observe(method, "stream")
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		done(err)
+		return nil, err
+	}
+	return &metricsStream{ClientStream: cs, done: done}, nil
+}
+
+type metricsStream struct {
+	grpc.ClientStream
+	done func(error)
+	once sync.Once
+}
+
+func (s *metricsStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.once.Do(func() {
+			if err == io.EOF {
+				s.done(nil)
+			} else {
+				s.done(err)
+			}
+		})
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package cinterceptors
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	errors "github.com/hkensame/goken/pkg/errors"
+	"github.com/hkensame/goken/pkg/log"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryConfig是客户端重试的配置,零值字段使用默认值
+type RetryConfig struct {
+	//包括第一次在内的最大请求次数,默认为3
+	MaxAttempts int
+	//第一次重试前的等待时间,之后每次翻倍,默认为50ms
+	BaseBackoff time.Duration
+	//重试等待时间的上限,默认为1s
+	MaxBackoff time.Duration
+	//单次请求的超时时间,为0时只受调用者ctx的限制
+	PerAttemptTimeout time.Duration
+	//可以重试的状态码,默认为Unavailable,ResourceExhausted与Aborted
+	RetryableCodes []codes.Code
+}
+
+func (c *RetryConfig) withDefaults() RetryConfig {
+	cfg := RetryConfig{}
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 3
+	}
+	if cfg.BaseBackoff <= 0 {
+		cfg.BaseBackoff = time.Millisecond * 50
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Second
+	}
+	if len(cfg.RetryableCodes) == 0 {
+		cfg.RetryableCodes = []codes.Code{codes.Unavailable, codes.ResourceExhausted, codes.Aborted}
+	}
+	return cfg
+}
+
+// backoff返回第attempt次重试前的等待时间,在[d/2,d)之间随机,避免大量客户端同时重试
+func (c *RetryConfig) backoff(attempt int) time.Duration {
+	d := c.BaseBackoff << min(attempt, 16)
+	if d <= 0 || d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// GrpcCode返回err对应的gRPC状态码,携带pkg/errors错误码的error以Coder.GrpcCode()为准
+func GrpcCode(err error) codes.Code {
+	if coder := errors.ExtractCoderFromError(err); coder != nil {
+		return coder.GrpcCode()
+	}
+	return status.Code(err)
+}
+
+// retryHint读取错误中服务端建议的重试间隔
+func retryHint(err error) (time.Duration, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return 0, false
+	}
+	for _, d := range st.Details() {
+		if ri, ok := d.(*errdetails.RetryInfo); ok && ri.GetRetryDelay() != nil {
+			return ri.GetRetryDelay().AsDuration(), true
+		}
+	}
+	return 0, false
+}
+
+// UnaryRetryInterceptor在请求返回可重试的状态码时按指数退避重试,流式请求不会被重试
+func UnaryRetryInterceptor(c *RetryConfig) grpc.UnaryClientInterceptor {
+	cfg := c.withDefaults()
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		for attempt := 1; ; attempt++ {
+			actx, cancel := ctx, context.CancelFunc(func() {})
+			if cfg.PerAttemptTimeout > 0 {
+				actx, cancel = context.WithTimeout(ctx, cfg.PerAttemptTimeout)
+			}
+			err := invoker(actx, method, req, reply, cc, opts...)
+			cancel()
+			if err == nil || attempt >= cfg.MaxAttempts || ctx.Err() != nil {
+				return err
+			}
+			code := GrpcCode(err)
+			//单次请求超时而调用者的ctx仍然有效时同样可以重试
+			if !slices.Contains(cfg.RetryableCodes, code) && !(cfg.PerAttemptTimeout > 0 && code == codes.DeadlineExceeded) {
+				return err
+			}
+
+			wait := cfg.backoff(attempt - 1)
+			//服务端通过RetryInfo给出了重试间隔时至少等待该时间
+			if hint, ok := retryHint(err); ok {
+				wait = max(wait, hint)
+			}
+			log.Debugf("[rpcclient] 请求%s失败,%v后进行第%d次重试 err = %v", method, wait, attempt, err)
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+	}
+}
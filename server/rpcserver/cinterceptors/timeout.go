@@ -0,0 +1,39 @@
+package cinterceptors
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// MethodTimeoutConf为指定方法设置默认的超时时间
+type MethodTimeoutConf struct {
+	FullMethod string
+	Timeout    time.Duration
+}
+
+// UnaryTimeoutInterceptor为没有deadline的请求设置默认的超时时间,
+// 调用者的ctx已经带有deadline时保持不变,deadline会随请求传递给服务端
+func UnaryTimeoutInterceptor(timeout time.Duration, methodTimeouts ...MethodTimeoutConf) grpc.UnaryClientInterceptor {
+	timeouts := make(map[string]time.Duration, len(methodTimeouts))
+	for _, mt := range methodTimeouts {
+		if mt.FullMethod != "" {
+			timeouts[mt.FullMethod] = mt.Timeout
+		}
+	}
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t, ok := timeouts[method]
+			if !ok {
+				t = timeout
+			}
+			if t > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, t)
+				defer cancel()
+			}
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
@@ -2,22 +2,32 @@ package rpcserver
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/url"
+	"time"
 
+	"github.com/hkensame/goken/pkg/common/tlsutil"
 	"github.com/hkensame/goken/registry"
+	"github.com/hkensame/goken/server/rpcserver/balancer"
+	"github.com/hkensame/goken/server/rpcserver/cinterceptors"
 
 	discover "github.com/hkensame/goken/registry/discover"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	grpcinsecure "google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
 )
 
 const (
-	RoundRobin      string = "round_robin"
-	LeastConnection string = "least_connection"
-	PickFirst       string = "pick_first"
+	RoundRobin         string = "round_robin"
+	PickFirst          string = "pick_first"
+	WeightedRoundRobin string = balancer.WeightedRoundRobin
+	//使用P2C实现,选择未完成请求更少的连接
+	LeastConnection string = balancer.P2C
+	ZoneAffinity    string = balancer.ZoneAffinity
+	RingHash        string = balancer.RingHash
 )
 
 type ClientOption func(o *Client)
@@ -33,11 +43,30 @@ type Client struct {
 	StreamInts []grpc.StreamClientInterceptor
 	GrpcOpts   []grpc.DialOption
 	//用于grpc的负载均衡
-	BalanceModel  string
-	EnableTracing bool
-	EnableMetrics bool
-	Insecure      bool
-	client        *grpc.ClientConn
+	BalanceModel string
+	//传给goken负载均衡器的配置,如zone与哈希header
+	BalanceConfig balancer.Config
+	//客户端离群检测,只在使用服务发现时生效
+	OutlierDetector *discover.OutlierDetector
+	EnableTracing   bool
+	EnableMetrics   bool
+	Insecure        bool
+	//不为nil时使用该证书建立TLS连接,设置了CA时用其校验服务端证书
+	TLS *tlsutil.Reloader
+	//校验服务端证书时使用的域名,为空时使用连接的目标地址
+	ServerName string
+	client     *grpc.ClientConn
+
+	//以下拦截器均默认关闭,开启后位于UnaryInts之前
+	EnableRetry   bool
+	Retry         cinterceptors.RetryConfig
+	EnableHedging bool
+	Hedging       cinterceptors.HedgingConfig
+	EnableBreaker bool
+	Breaker       cinterceptors.BreakerConfig
+	//没有deadline的请求使用的默认超时时间,为0时不设置
+	Timeout        time.Duration
+	MethodTimeouts []cinterceptors.MethodTimeoutConf
 }
 
 func MustNewClient(ctx context.Context, target string, opts ...ClientOption) *Client {
@@ -62,7 +91,18 @@ func MustNewClient(ctx context.Context, target string, opts ...ClientOption) *Cl
 	for _, o := range opts {
 		o(c)
 	}
-	c.GrpcOpts = append(c.GrpcOpts, grpc.WithDefaultServiceConfig(`{"loadBalancingPolicy": "`+c.BalanceModel+`"}`))
+	if c.TLS != nil || u.Scheme == registry.ProtocolGRPCS {
+		c.Insecure = false
+	}
+	c.GrpcOpts = append(c.GrpcOpts, grpc.WithDefaultServiceConfig(c.serviceConfig()))
+	unaryInts, streamInts := c.defaultInterceptors()
+	c.UnaryInts = append(unaryInts, c.UnaryInts...)
+	c.StreamInts = append(streamInts, c.StreamInts...)
+	if c.Discover != nil && c.OutlierDetector != nil {
+		//放在最内层,保证每一次实际发出的请求都被统计
+		c.UnaryInts = append(c.UnaryInts, c.OutlierDetector.UnaryClientInterceptor())
+		c.StreamInts = append(c.StreamInts, c.OutlierDetector.StreamClientInterceptor())
+	}
 	c.GrpcOpts = append(c.GrpcOpts, grpc.WithChainUnaryInterceptor(c.UnaryInts...))
 	c.GrpcOpts = append(c.GrpcOpts, grpc.WithChainStreamInterceptor(c.StreamInts...))
 
@@ -70,16 +110,66 @@ func MustNewClient(ctx context.Context, target string, opts ...ClientOption) *Cl
 		c.Endpoint.Scheme = "discovery"
 		c.Endpoint.Host = "127.0.0.1:65535"
 		c.GrpcOpts = append(c.GrpcOpts, grpc.WithResolvers(
-			discover.MustNewBuilder(c.Discover),
+			discover.MustNewBuilder(c.Discover, discover.WithOutlierDetector(c.OutlierDetector), discover.WithInsecure(c.Insecure)),
 		))
 	}
 
-	if c.Insecure {
+	switch {
+	case c.Insecure:
 		c.GrpcOpts = append(c.GrpcOpts, grpc.WithTransportCredentials(grpcinsecure.NewCredentials()))
+	case c.TLS != nil:
+		c.GrpcOpts = append(c.GrpcOpts, grpc.WithTransportCredentials(credentials.NewTLS(c.TLS.ClientConfig(c.ServerName))))
+	default:
+		//未指定证书时使用系统的根证书校验服务端
+		c.GrpcOpts = append(c.GrpcOpts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ServerName: c.ServerName,
+		})))
 	}
 	return c
 }
 
+func (c *Client) serviceConfig() string {
+	switch c.BalanceModel {
+	case PickFirst:
+		return `{"loadBalancingPolicy": "` + c.BalanceModel + `"}`
+	case RoundRobin:
+		//使用goken的轮询实现,从而离群检测能够取得选中实例在resolver中的地址
+		return balancer.ServiceConfig(balancer.RoundRobin, nil)
+	}
+	return balancer.ServiceConfig(c.BalanceModel, &c.BalanceConfig)
+}
+
+// defaultInterceptors按照开关返回默认的拦截器链,从外到内依次为
+// tracing,metrics,默认超时,熔断,重试,对冲,
+// 因此一次调用内的多次重试与对冲请求只被熔断器与指标计为一次,并共享同一个deadline
+func (c *Client) defaultInterceptors() ([]grpc.UnaryClientInterceptor, []grpc.StreamClientInterceptor) {
+	var unary []grpc.UnaryClientInterceptor
+	var stream []grpc.StreamClientInterceptor
+	if c.EnableTracing {
+		unary = append(unary, cinterceptors.UnaryTracingInterceptor)
+		stream = append(stream, cinterceptors.StreamTracingInterceptor)
+	}
+	if c.EnableMetrics {
+		unary = append(unary, cinterceptors.UnaryMetricsInterceptor)
+		stream = append(stream, cinterceptors.StreamMetricsInterceptor)
+	}
+	if c.Timeout > 0 || len(c.MethodTimeouts) > 0 {
+		unary = append(unary, cinterceptors.UnaryTimeoutInterceptor(c.Timeout, c.MethodTimeouts...))
+	}
+	if c.EnableBreaker {
+		unary = append(unary, cinterceptors.UnaryBreakerInterceptor(&c.Breaker))
+		stream = append(stream, cinterceptors.StreamBreakerInterceptor(&c.Breaker))
+	}
+	if c.EnableRetry {
+		unary = append(unary, cinterceptors.UnaryRetryInterceptor(&c.Retry))
+	}
+	if c.EnableHedging {
+		unary = append(unary, cinterceptors.UnaryHedgingInterceptor(&c.Hedging))
+	}
+	return unary, stream
+}
+
 func (c *Client) CtxWithMetadata(md metadata.MD) context.Context {
 	return metadata.NewOutgoingContext(c.Ctx, md)
 }
@@ -96,9 +186,70 @@ func WithSercure(on bool) ClientOption {
 	}
 }
 
+// 使用TLS连接服务端,certFile与keyFile不为空时作为客户端证书(mTLS),caFile为空时使用系统的根证书,
+// 证书文件被替换后会自动重新加载
+func WithClientTLS(certFile, keyFile, caFile string) ClientOption {
+	return func(o *Client) {
+		o.TLS = tlsutil.MustNewReloader(certFile, keyFile, caFile)
+	}
+}
+
+// 设置校验服务端证书时使用的域名,使用服务发现时目标地址不是真实的域名,一般需要设置该选项
+func WithTLSServerName(name string) ClientOption {
+	return func(o *Client) {
+		o.ServerName = name
+	}
+}
+
+// 把上游http或rpc请求携带的jwt token转发给下游服务
+func WithForwardJWT() ClientOption {
+	return func(o *Client) {
+		o.UnaryInts = append(o.UnaryInts, cinterceptors.UnaryJWTForwardInterceptor)
+		o.StreamInts = append(o.StreamInts, cinterceptors.StreamJWTForwardInterceptor)
+	}
+}
+
 func WithEnableMetrics(on bool) ClientOption {
 	return func(o *Client) {
-		o.EnableTracing = on
+		o.EnableMetrics = on
+	}
+}
+
+// 开启重试,返回可重试状态码的一元请求会按指数退避重试,cfg为nil时使用默认配置
+func WithRetry(cfg *cinterceptors.RetryConfig) ClientOption {
+	return func(o *Client) {
+		o.EnableRetry = true
+		if cfg != nil {
+			o.Retry = *cfg
+		}
+	}
+}
+
+// 为cfg.Methods中的幂等方法开启对冲请求
+func WithHedging(cfg *cinterceptors.HedgingConfig) ClientOption {
+	return func(o *Client) {
+		o.EnableHedging = true
+		if cfg != nil {
+			o.Hedging = *cfg
+		}
+	}
+}
+
+// 开启熔断,每个目标使用一个独立的熔断器,cfg为nil时使用默认配置
+func WithCircuitBreaker(cfg *cinterceptors.BreakerConfig) ClientOption {
+	return func(o *Client) {
+		o.EnableBreaker = true
+		if cfg != nil {
+			o.Breaker = *cfg
+		}
+	}
+}
+
+// 为没有deadline的请求设置默认超时时间,methodTimeouts可以为指定方法设置不同的超时时间
+func WithClientTimeout(timeout time.Duration, methodTimeouts ...cinterceptors.MethodTimeoutConf) ClientOption {
+	return func(o *Client) {
+		o.Timeout = timeout
+		o.MethodTimeouts = append(o.MethodTimeouts, methodTimeouts...)
 	}
 }
 
@@ -134,9 +285,7 @@ func WithDialOptions(opts ...grpc.DialOption) ClientOption {
 func WithBalanceModel(model string) ClientOption {
 	return func(o *Client) {
 		switch model {
-		case RoundRobin:
-			o.BalanceModel = model
-		case PickFirst:
+		case RoundRobin, PickFirst, WeightedRoundRobin, LeastConnection, ZoneAffinity, RingHash:
 			o.BalanceModel = model
 		default:
 			o.BalanceModel = RoundRobin
@@ -145,6 +294,28 @@ func WithBalanceModel(model string) ClientOption {
 	}
 }
 
+// 设置客户端所在的zone,ZoneAffinity负载均衡器会优先选择metadata中zone相同的实例
+func WithZone(zone string) ClientOption {
+	return func(o *Client) {
+		o.BalanceConfig.Zone = zone
+	}
+}
+
+// 开启客户端离群检测,连续失败或错误率过高的实例会被临时摘除,cfg为nil时使用默认配置,
+// 只在goken的负载均衡器(包括RoundRobin)下生效,PickFirst下不会统计请求结果
+func WithOutlierDetection(cfg *discover.OutlierConfig) ClientOption {
+	return func(o *Client) {
+		o.OutlierDetector = discover.NewOutlierDetector(cfg)
+	}
+}
+
+// 设置RingHash负载均衡器从请求metadata中读取哈希key的header,默认为x-hash-key
+func WithHashHeader(header string) ClientOption {
+	return func(o *Client) {
+		o.BalanceConfig.HashHeader = header
+	}
+}
+
 func (c *Client) Reset() {
 	if c.client != nil {
 		c.client.Close()
@@ -0,0 +1,82 @@
+package rpcserver
+
+import (
+	"context"
+	"time"
+
+	"github.com/hkensame/goken/pkg/log"
+)
+
+// Drain按照以下顺序优雅下线服务,多次调用只会执行一次:
+//  1. 健康检查置为NOT_SERVING,依赖健康检查的负载均衡器不再把新请求路由过来
+//  2. 从注册中心注销服务
+//  3. 等待DrainDelay,让注册中心与客户端感知到服务下线
+//  4. 停止接收新请求并等待进行中的请求完成,超过StopTimeout后强制关闭
+//
+// ctx结束时会跳过剩余的等待直接强制关闭
+func (s *Server) Drain(ctx context.Context) error {
+	s.drainOnce.Do(func() {
+		s.drainErr = s.drain(ctx)
+	})
+	return s.drainErr
+}
+
+func (s *Server) drain(ctx context.Context) error {
+	log.Infof("[rpcserver] 服务开始下线, host = %s", s.Host)
+	s.SetNotServing()
+
+	var err error
+	if e := s.Deregister(ctx); e != nil && e != ErrNilRpcRegistor {
+		log.Errorf("[rpcserver] 服务注销失败, err= %v", e)
+		err = e
+	} else if e == nil {
+		log.Info("[rpcserver] 服务正常注销")
+		if s.DrainDelay > 0 {
+			select {
+			case <-time.After(s.DrainDelay):
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	s.stop(ctx)
+	return err
+}
+
+// SetNotServing把健康检查置为NOT_SERVING,但依然会正常处理请求,一般由app在注销服务前调用
+func (s *Server) SetNotServing() {
+	s.Health.Shutdown()
+}
+
+// Shutdown把健康检查置为NOT_SERVING并停止服务,与Drain不同的是不会注销服务,
+// 一般由统一管理服务注册的app调用
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.SetNotServing()
+	return s.stop(ctx)
+}
+
+// stop停止接收新请求并等待进行中的请求完成,超过StopTimeout或ctx结束后强制关闭
+func (s *Server) stop(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.Server.GracefulStop()
+		close(stopped)
+	}()
+	var timeout <-chan time.Time
+	if s.StopTimeout > 0 {
+		timer := time.NewTimer(s.StopTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-stopped:
+		log.Info("[rpcserver] 服务已停止")
+	case <-timeout:
+		log.Warnf("[rpcserver] 等待进行中的请求超过%v,强制关闭服务", s.StopTimeout)
+		s.Server.Stop()
+	case <-ctx.Done():
+		log.Warn("[rpcserver] 下线被取消,强制关闭服务")
+		s.Server.Stop()
+	}
+	return nil
+}
@@ -2,9 +2,7 @@ package rpcserver
 
 import (
 	"context"
-	"fmt"
 	"net"
-	"net/url"
 	"os"
 	"os/signal"
 	"sync"
@@ -14,12 +12,15 @@ import (
 	"github.com/hkensame/goken/registry"
 
 	"github.com/hkensame/goken/pkg/common/hostgen"
+	"github.com/hkensame/goken/pkg/common/tlsutil"
 	errors "github.com/hkensame/goken/pkg/errors"
 	"github.com/hkensame/goken/pkg/log"
+	kjwt "github.com/hkensame/goken/server/httpserver/middlewares/jwt"
 	sinterceptors "github.com/hkensame/goken/server/rpcserver/sinterceptors"
 
 	"github.com/oklog/run"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
@@ -41,7 +42,30 @@ type Server struct {
 	//timeout  time.Duration
 	Health   *health.Server
 	Instance *registry.ServiceInstance
-	closed   bool
+	//WithServiceName等修改实例的选项,在确定Instance后统一应用,与WithServiceInstance的先后顺序无关
+	insOpts []func(*registry.ServiceInstance)
+	closed  bool
+
+	//注销服务后等待注册中心与客户端感知到变化的时间,只在存在注册器时等待
+	DrainDelay time.Duration
+	//等待进行中的请求完成的最长时间,超时后强制关闭所有连接
+	StopTimeout time.Duration
+	drainOnce   sync.Once
+	drainErr    error
+
+	//默认拦截器链的开关,均默认开启,默认拦截器位于UnaryInts与StreamInts之前
+	EnableTracing      bool
+	EnableMetrics      bool
+	EnableAccessLog    bool
+	EnableErrorMapping bool
+	EnableRecovery     bool
+
+	//不为nil时使用TLS,并以grpcs协议注册endpoint
+	TLS *tlsutil.Reloader
+
+	//过载保护,为nil时不开启,位于默认拦截器链的最内层
+	Shedder *sinterceptors.CPUShedder
+	Limiter *sinterceptors.AdaptiveLimiter
 }
 
 var ErrNilRpcRegistor = errors.New("该rpc服务不存在注册器")
@@ -49,7 +73,15 @@ var ErrNilRpcRegistor = errors.New("该rpc服务不存在注册器")
 func (s *Server) listen() error {
 
 	if s.Lis != nil {
-		s.Host = s.Lis.Addr().String()
+		//外部传入的Lis可能监听在0.0.0.0上,需要解析出可供访问的地址
+		addr, err := hostgen.ResolveHost(s.Lis.Addr().String())
+		if err != nil {
+			return err
+		}
+		if addr == "" {
+			addr = s.Lis.Addr().String()
+		}
+		s.Host = addr
 		return nil
 	}
 	//检查并获得合适的地址用于服务注册
@@ -64,17 +96,29 @@ func (s *Server) listen() error {
 }
 
 func MustNewServer(ctx context.Context, opts ...ServerOption) *Server {
+	hs := health.NewServer()
 	s := &Server{
-		Host:      "127.0.0.1:0",
-		Health:    health.NewServer(),
-		Ctx:       ctx,
-		Instance:  new(registry.ServiceInstance),
-		UnaryInts: []grpc.UnaryServerInterceptor{sinterceptors.HealthCheckInterceptor()},
-		closed:    false,
+		Host:        "127.0.0.1:0",
+		Health:      hs,
+		Ctx:         ctx,
+		Instance:    new(registry.ServiceInstance),
+		UnaryInts:   []grpc.UnaryServerInterceptor{sinterceptors.HealthCheckInterceptor(hs)},
+		closed:      false,
+		DrainDelay:  time.Second * 3,
+		StopTimeout: time.Second * 10,
+
+		EnableTracing:      true,
+		EnableMetrics:      true,
+		EnableAccessLog:    true,
+		EnableErrorMapping: true,
+		EnableRecovery:     true,
 	}
 	for _, v := range opts {
 		v(s)
 	}
+	for _, o := range s.insOpts {
+		o(s.Instance)
+	}
 
 	if err := s.listen(); err != nil {
 		panic(err)
@@ -87,16 +131,18 @@ func MustNewServer(ctx context.Context, opts ...ServerOption) *Server {
 		s.Instance.Name = s.Host
 	}
 
-	u, err := url.Parse(fmt.Sprintf("%s://%s", "grpc", s.Host))
-	if err != nil {
-		panic(err)
+	protocol := registry.ProtocolGRPC
+	if s.TLS != nil {
+		protocol = registry.ProtocolGRPCS
+		s.GrpcOpts = append(s.GrpcOpts, grpc.Creds(credentials.NewTLS(s.TLS.ServerConfig())))
 	}
-	s.Instance.Endpoints = append(s.Instance.Endpoints, u)
+	s.Instance.AddEndpoint(registry.Endpoint{Protocol: protocol, Address: s.Host})
 
 	//s.unaryInts = append(s.unaryInts, interceptors.UnaryTimeoutInterceptor(s.timeout))
 
-	s.GrpcOpts = append(s.GrpcOpts, grpc.ChainUnaryInterceptor(s.UnaryInts...))
-	s.GrpcOpts = append(s.GrpcOpts, grpc.ChainStreamInterceptor(s.StreamInts...))
+	unaryInts, streamInts := s.defaultInterceptors()
+	s.GrpcOpts = append(s.GrpcOpts, grpc.ChainUnaryInterceptor(append(unaryInts, s.UnaryInts...)...))
+	s.GrpcOpts = append(s.GrpcOpts, grpc.ChainStreamInterceptor(append(streamInts, s.StreamInts...)...))
 	s.Server = grpc.NewServer(s.GrpcOpts...)
 
 	grpc_health_v1.RegisterHealthServer(s.Server, s.Health)
@@ -105,6 +151,43 @@ func MustNewServer(ctx context.Context, opts ...ServerOption) *Server {
 	return s
 }
 
+// defaultInterceptors按照开关返回默认的拦截器链,从外到内依次为
+// tracing,metrics,访问日志,错误转换,panic恢复,CPU过载保护,自适应限流,
+// 因此panic与普通error都会先被转换为带错误码的status,再被记录到日志与指标中
+func (s *Server) defaultInterceptors() ([]grpc.UnaryServerInterceptor, []grpc.StreamServerInterceptor) {
+	var unary []grpc.UnaryServerInterceptor
+	var stream []grpc.StreamServerInterceptor
+	if s.EnableTracing {
+		unary = append(unary, sinterceptors.UnaryTracingInterceptor)
+		stream = append(stream, sinterceptors.StreamTracingInterceptor)
+	}
+	if s.EnableMetrics {
+		unary = append(unary, sinterceptors.UnaryMetricsInterceptor)
+		stream = append(stream, sinterceptors.StreamMetricsInterceptor)
+	}
+	if s.EnableAccessLog {
+		unary = append(unary, sinterceptors.UnaryAccessLogInterceptor)
+		stream = append(stream, sinterceptors.StreamAccessLogInterceptor)
+	}
+	if s.EnableErrorMapping {
+		unary = append(unary, sinterceptors.UnaryErrorMappingInterceptor)
+		stream = append(stream, sinterceptors.StreamErrorMappingInterceptor)
+	}
+	if s.EnableRecovery {
+		unary = append(unary, sinterceptors.UnaryRecoveryInterceptor)
+		stream = append(stream, sinterceptors.StreamRecoveryInterceptor)
+	}
+	if s.Shedder != nil {
+		unary = append(unary, s.Shedder.UnaryServerInterceptor())
+		stream = append(stream, s.Shedder.StreamServerInterceptor())
+	}
+	if s.Limiter != nil {
+		unary = append(unary, s.Limiter.UnaryServerInterceptor())
+		stream = append(stream, s.Limiter.StreamServerInterceptor())
+	}
+	return unary, stream
+}
+
 func (s *Server) Register(ctx context.Context, ins *registry.ServiceInstance) error {
 	if s.Registor == nil {
 		return ErrNilRpcRegistor
@@ -124,6 +207,21 @@ func (s *Server) Deregister(ctx context.Context) error {
 	return nil
 }
 
+// Run在Lis上接收请求,阻塞直到服务停止,不会注册服务也不会监听终止信号,一般由app调用
+func (s *Server) Run(ctx context.Context) error {
+	log.Infof("[rpcserver] 服务启动中,监听信息为: host = %s", s.Host)
+	if err := s.Server.Serve(s.Lis); err != nil {
+		log.Errorf("[rpcserver] 服务启动失败, err= %v", err)
+		return err
+	}
+	return nil
+}
+
+// ServiceInstance返回需要注册到注册中心的服务实例
+func (s *Server) ServiceInstance() *registry.ServiceInstance {
+	return s.Instance
+}
+
 func (s *Server) Serve() error {
 	g := &run.Group{}
 	//运行前前打印配置信息
@@ -133,18 +231,6 @@ func (s *Server) Serve() error {
 		return err
 	}
 
-	// 确保Deregister只执行一次
-	var deregisterOnce sync.Once
-	deregisterFunc := func() {
-		deregisterOnce.Do(func() {
-			if e := s.Deregister(s.Ctx); e != nil && e != ErrNilRpcRegistor {
-				log.Errorf("[httpserver] 服务注销失败, err= %v", e)
-			} else {
-				log.Info("[httpserver] 服务正常注销")
-			}
-		})
-	}
-
 	//监听终止信号,优雅退出
 	sign := make(chan os.Signal, 1)
 	signal.Notify(sign, syscall.SIGTERM, syscall.SIGINT)
@@ -157,17 +243,14 @@ func (s *Server) Serve() error {
 			return nil
 		},
 		func(err error) {
-			s.Server.GracefulStop()
-			deregisterFunc()
+			s.Drain(context.Background())
 		},
 	)
 
 	g.Add(
 		func() error {
 			<-sign
-			s.Server.GracefulStop()
-			deregisterFunc()
-			return nil
+			return s.Drain(context.Background())
 		},
 		func(err error) {
 			sign <- syscall.SIGINT
@@ -188,6 +271,26 @@ func WithTimeout(timeout time.Duration) ServerOption {
 	}
 }
 
+// 为流式请求设置空闲超时,最长持续时间,消息数与消息速率的限制,methodPolicies可以为指定方法设置不同的限制
+func WithStreamPolicy(def sinterceptors.StreamPolicyConf, methodPolicies ...sinterceptors.StreamPolicyConf) ServerOption {
+	return func(o *Server) {
+		o.StreamInts = append(o.StreamInts, sinterceptors.StreamPolicyInterceptor(def, methodPolicies...))
+	}
+}
+
+// 使用fn认证一元与流式请求,健康检查与skipMethods中的方法不需要认证
+func WithAuth(fn sinterceptors.AuthFunc, skipMethods ...string) ServerOption {
+	return func(o *Server) {
+		o.UnaryInts = append(o.UnaryInts, sinterceptors.UnaryAuthInterceptor(fn, skipMethods...))
+		o.StreamInts = append(o.StreamInts, sinterceptors.StreamAuthInterceptor(fn, skipMethods...))
+	}
+}
+
+// 使用与http jwt中间件相同的规则认证请求,健康检查,反射与allowMethods中的方法不需要认证
+func WithJWTAuth(mw *kjwt.GinJWTMiddleware, allowMethods ...string) ServerOption {
+	return WithAuth(sinterceptors.JWTAuth(mw), allowMethods...)
+}
+
 func WithListener(lis net.Listener) ServerOption {
 	return func(o *Server) {
 		o.Lis = lis
@@ -218,26 +321,98 @@ func WithRegistor(r registry.Registor) ServerOption {
 	}
 }
 
-// func WithServiceInstance(ins *registry.ServiceInstance) ServerOption {
-// 	return func(o *Server) {
-// 		o.Instance = ins
-// 	}
-// }
+// 使用ins作为该服务的实例,多个服务(如同一进程中的http与grpc服务)传入同一个ins时会把各自的endpoint加入其中,
+// 由app合并注册为一个实例,WithServiceName等选项会作用在ins上
+func WithServiceInstance(ins *registry.ServiceInstance) ServerOption {
+	return func(o *Server) {
+		o.Instance = ins
+	}
+}
 
 func WithServiceName(name string) ServerOption {
 	return func(o *Server) {
-		o.Instance.Name = name
+		o.insOpts = append(o.insOpts, func(ins *registry.ServiceInstance) { ins.Name = name })
 	}
 }
 
 func WithServiceID(id string) ServerOption {
 	return func(o *Server) {
-		o.Instance.ID = id
+		o.insOpts = append(o.insOpts, func(ins *registry.ServiceInstance) { ins.ID = id })
 	}
 }
 
 func WithVersion(v string) ServerOption {
 	return func(o *Server) {
-		o.Instance.Version = v
+		o.insOpts = append(o.insOpts, func(ins *registry.ServiceInstance) { ins.Version = v })
+	}
+}
+
+// 注销服务后等待d时间再停止接收请求,给注册中心与客户端留出感知服务下线的时间
+func WithDrainDelay(d time.Duration) ServerOption {
+	return func(o *Server) {
+		o.DrainDelay = d
+	}
+}
+
+// 停止服务时等待进行中的请求完成的最长时间
+func WithStopTimeout(d time.Duration) ServerOption {
+	return func(o *Server) {
+		o.StopTimeout = d
+	}
+}
+
+// 是否开启服务端tracing,默认开启
+func WithServerTracing(on bool) ServerOption {
+	return func(o *Server) {
+		o.EnableTracing = on
+	}
+}
+
+// 是否开启prometheus指标,指标注册在prometheus.DefaultRegisterer中,默认开启
+func WithServerMetrics(on bool) ServerOption {
+	return func(o *Server) {
+		o.EnableMetrics = on
+	}
+}
+
+// 是否为每个请求记录访问日志,默认开启
+func WithAccessLog(on bool) ServerOption {
+	return func(o *Server) {
+		o.EnableAccessLog = on
+	}
+}
+
+// 是否把handler返回的普通error转换为带错误码的status,默认开启
+func WithErrorMapping(on bool) ServerOption {
+	return func(o *Server) {
+		o.EnableErrorMapping = on
+	}
+}
+
+// 是否捕获handler中的panic,默认开启
+func WithRecovery(on bool) ServerOption {
+	return func(o *Server) {
+		o.EnableRecovery = on
+	}
+}
+
+// 开启自适应并发限流,超过并发上限的请求返回ResourceExhausted,cfg为nil时使用默认配置
+func WithAdaptiveLimiter(cfg *sinterceptors.AdaptiveLimiterConfig) ServerOption {
+	return func(o *Server) {
+		o.Limiter = sinterceptors.NewAdaptiveLimiter(cfg)
+	}
+}
+
+// 开启基于CPU使用率的过载保护,cfg为nil时使用默认配置
+func WithCPUShedder(cfg *sinterceptors.CPUShedderConfig) ServerOption {
+	return func(o *Server) {
+		o.Shedder = sinterceptors.NewCPUShedder(o.Ctx, cfg)
+	}
+}
+
+// 开启TLS,caFile不为空时要求客户端提供由该CA签发的证书(mTLS),证书文件被替换后会自动重新加载
+func WithTLS(certFile, keyFile, caFile string) ServerOption {
+	return func(o *Server) {
+		o.TLS = tlsutil.MustNewReloader(certFile, keyFile, caFile)
 	}
 }
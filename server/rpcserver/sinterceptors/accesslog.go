@@ -0,0 +1,53 @@
+package sinterceptors
+
+import (
+	"context"
+	"time"
+
+	"github.com/hkensame/goken/pkg/log"
+	ktrace "github.com/hkensame/goken/pkg/trace"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryAccessLogInterceptor为每个一元请求记录一条结构化的访问日志,
+// 成功的请求为Info级别,客户端错误为Warn级别,服务端错误为Error级别
+func UnaryAccessLogInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	accessLog(ctx, info.FullMethod, "unary", start, err)
+	return resp, err
+}
+
+// StreamAccessLogInterceptor在流结束时记录一条访问日志
+func StreamAccessLogInterceptor(svr any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(svr, ss)
+	accessLog(ss.Context(), info.FullMethod, "stream", start, err)
+	return err
+}
+
+func accessLog(ctx context.Context, method string, kind string, start time.Time, err error) {
+	code := status.Code(err)
+	kv := []any{
+		"method", method,
+		"type", kind,
+		"peer", ktrace.PeerAddrFromCtx(ctx),
+		"code", code.String(),
+		"duration", time.Since(start).String(),
+	}
+	if err != nil {
+		kv = append(kv, "error", err.Error())
+	}
+
+	switch code {
+	case codes.OK:
+		log.InfowContext(ctx, "[rpcserver] access", kv...)
+	case codes.Internal, codes.Unknown, codes.DataLoss, codes.Unimplemented, codes.Unavailable:
+		log.ErrorwContext(ctx, "[rpcserver] access", kv...)
+	default:
+		log.WarnwContext(ctx, "[rpcserver] access", kv...)
+	}
+}
@@ -0,0 +1,84 @@
+package sinterceptors
+
+import (
+	"context"
+	"strings"
+
+	errors "github.com/hkensame/goken/pkg/errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AuthFunc对请求进行认证,返回的ctx会传给handler,一般用于携带认证得到的身份信息
+type AuthFunc func(ctx context.Context, fullMethod string) (context.Context, error)
+
+// 健康检查与反射服务的方法总是不需要认证
+var authFreeServices = []string{
+	"/grpc.health.v1.Health/",
+	"/grpc.reflection.v1.ServerReflection/",
+	"/grpc.reflection.v1alpha.ServerReflection/",
+}
+
+func skipAuth(method string, skip map[string]struct{}) bool {
+	if _, ok := skip[method]; ok {
+		return true
+	}
+	for _, s := range authFreeServices {
+		if strings.HasPrefix(method, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnaryAuthInterceptor使用fn认证一元请求,健康检查,反射与skipMethods中的方法不需要认证
+func UnaryAuthInterceptor(fn AuthFunc, skipMethods ...string) grpc.UnaryServerInterceptor {
+	skip := methodSet(skipMethods)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if skipAuth(info.FullMethod, skip) {
+			return handler(ctx, req)
+		}
+		ctx, err := fn(ctx, info.FullMethod)
+		if err != nil {
+			return nil, authError(err)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamAuthInterceptor在流建立时使用fn认证,认证失败时handler不会被调用
+func StreamAuthInterceptor(fn AuthFunc, skipMethods ...string) grpc.StreamServerInterceptor {
+	skip := methodSet(skipMethods)
+	return func(svr any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if skipAuth(info.FullMethod, skip) {
+			return handler(svr, ss)
+		}
+		ctx, err := fn(ss.Context(), info.FullMethod)
+		if err != nil {
+			return authError(err)
+		}
+		return handler(svr, &authStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authError让没有携带错误码或gRPC status的认证错误返回Unauthenticated
+func authError(err error) error {
+	if errors.IfWithCoder(err) {
+		return err
+	}
+	if _, ok := status.FromError(err); ok && status.Code(err) != codes.Unknown {
+		return err
+	}
+	return status.Error(codes.Unauthenticated, err.Error())
+}
+
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package sinterceptors
+
+import (
+	"time"
+)
+
+// 不支持的平台上CPU时间总是为0,CPUShedder不会丢弃任何请求
+func processCPUTime() time.Duration {
+	return 0
+}
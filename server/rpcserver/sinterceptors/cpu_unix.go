@@ -0,0 +1,17 @@
+//go:build unix
+
+package sinterceptors
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUTime返回进程累计使用的CPU时间(用户态与内核态之和)
+func processCPUTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
@@ -0,0 +1,47 @@
+package sinterceptors
+
+import (
+	"context"
+
+	errors "github.com/hkensame/goken/pkg/errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryErrorMappingInterceptor把handler返回的普通error转换为带有pkg/errors错误码的gRPC status
+func UnaryErrorMappingInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	resp, err := handler(ctx, req)
+	return resp, MapError(err)
+}
+
+// StreamErrorMappingInterceptor把流式handler返回的普通error转换为带有pkg/errors错误码的gRPC status
+func StreamErrorMappingInterceptor(svr any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return MapError(handler(svr, ss))
+}
+
+// MapError把err转换为客户端可以解析的gRPC错误:
+// 已经携带错误码或gRPC status的错误保持不变(被Wrap过的也会取出其中的status),
+// context的取消与超时分别对应Canceled与DeadlineExceeded,其余错误一律视为CodeInternalError
+func MapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.IfWithCoder(err) {
+		return err
+	}
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		if st := se.GRPCStatus(); st.Code() != codes.Unknown {
+			return st.Err()
+		}
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return errors.WithCoder(err, errors.CodeCanceled, "")
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return errors.WithCoder(err, errors.CodeInternalError, "")
+}
@@ -9,11 +9,15 @@ import (
 
 const healthCheckMethod = "/grpc.health.v1.Health/Check"
 
-// 健康检查拦截器
-func HealthCheckInterceptor() grpc.UnaryServerInterceptor {
+// 健康检查拦截器,健康检查请求直接交给hs处理而不经过后续的拦截器(如鉴权,限流),
+// 因此服务下线前把hs置为NOT_SERVING后健康检查能够立即感知到
+func HealthCheckInterceptor(hs grpc_health_v1.HealthServer) grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 		// 判断请求是否为健康检查方法
 		if info.FullMethod == healthCheckMethod {
+			if r, ok := req.(*grpc_health_v1.HealthCheckRequest); ok && hs != nil {
+				return hs.Check(ctx, r)
+			}
 			return &grpc_health_v1.HealthCheckResponse{
 				Status: grpc_health_v1.HealthCheckResponse_SERVING,
 			}, nil
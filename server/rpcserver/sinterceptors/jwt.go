@@ -0,0 +1,43 @@
+package sinterceptors
+
+import (
+	"context"
+	"strings"
+
+	errors "github.com/hkensame/goken/pkg/errors"
+	kjwt "github.com/hkensame/goken/server/httpserver/middlewares/jwt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// JWTAuth返回使用mw校验token的AuthFunc,token从incoming metadata的mw.TokenHeadName(默认为authorization)中读取,
+// 与http中间件使用相同的密钥,算法与claims规则,校验通过后可以在handler中通过kjwt.ClaimsFromContext读取claims
+func JWTAuth(mw *kjwt.GinJWTMiddleware) AuthFunc {
+	header := strings.ToLower(mw.TokenHeadName)
+	return func(ctx context.Context, fullMethod string) (context.Context, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		vals := md.Get(header)
+		if len(vals) == 0 || vals[0] == "" {
+			return nil, errors.WithCoder(kjwt.ErrEmptyHeaderToken, errors.CodeMissingHeader, "")
+		}
+		claims, err := mw.ValidateToken(vals[0])
+		if err != nil {
+			if err == kjwt.ErrExpiredToken {
+				return nil, errors.WithCoder(err, errors.CodeExpired, "")
+			}
+			return nil, errors.WithCoder(err, errors.CodeTokenInvalid, "")
+		}
+		return kjwt.NewContext(ctx, claims, kjwt.TrimBearer(vals[0])), nil
+	}
+}
+
+// UnaryJWTAuthInterceptor使用mw认证一元请求,健康检查,反射与allowMethods中的方法不需要认证
+func UnaryJWTAuthInterceptor(mw *kjwt.GinJWTMiddleware, allowMethods ...string) grpc.UnaryServerInterceptor {
+	return UnaryAuthInterceptor(JWTAuth(mw), allowMethods...)
+}
+
+// StreamJWTAuthInterceptor使用mw认证流式请求,健康检查,反射与allowMethods中的方法不需要认证
+func StreamJWTAuthInterceptor(mw *kjwt.GinJWTMiddleware, allowMethods ...string) grpc.StreamServerInterceptor {
+	return StreamAuthInterceptor(JWTAuth(mw), allowMethods...)
+}
@@ -0,0 +1,198 @@
+package sinterceptors
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hkensame/goken/pkg/log"
+
+	"google.golang.org/grpc"
+)
+
+// AdaptiveLimiterConfig是自适应并发限流器的配置,零值字段使用默认值
+type AdaptiveLimiterConfig struct {
+	//初始的并发上限,默认为20
+	InitialLimit int
+	//并发上限的取值范围,默认为[5,1000]
+	MinLimit int
+	MaxLimit int
+	//允许的延迟膨胀倍数,短期延迟不超过基准延迟的Tolerance倍时不会降低并发上限,默认为1.5
+	Tolerance float64
+	//每次调整并发上限时新值所占的比重,默认为0.2
+	Smoothing float64
+	//延迟的采样周期,每个周期结束后调整一次并发上限,默认为100ms
+	Window time.Duration
+	//被拒绝的请求建议客户端等待的时间,默认为100ms
+	RetryAfter time.Duration
+	//不受限流影响的方法全名
+	CriticalMethods []string
+	//判断携带x-goken-priority: critical的请求是否来自可信的调用者,例如TrustPeerCertificate,
+	//为nil时忽略该header,只有健康检查与CriticalMethods不受限流影响
+	TrustPriority TrustFunc
+}
+
+func (c *AdaptiveLimiterConfig) withDefaults() AdaptiveLimiterConfig {
+	cfg := AdaptiveLimiterConfig{}
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.MinLimit <= 0 {
+		cfg.MinLimit = 5
+	}
+	if cfg.MaxLimit <= 0 {
+		cfg.MaxLimit = 1000
+	}
+	cfg.MaxLimit = max(cfg.MaxLimit, cfg.MinLimit)
+	if cfg.InitialLimit <= 0 {
+		cfg.InitialLimit = 20
+	}
+	cfg.InitialLimit = min(max(cfg.InitialLimit, cfg.MinLimit), cfg.MaxLimit)
+	if cfg.Tolerance < 1 {
+		cfg.Tolerance = 1.5
+	}
+	if cfg.Smoothing <= 0 || cfg.Smoothing > 1 {
+		cfg.Smoothing = 0.2
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = time.Millisecond * 100
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = time.Millisecond * 100
+	}
+	return cfg
+}
+
+// AdaptiveLimiter根据观察到的延迟动态调整服务端的并发上限(gradient算法):
+// 以观察到的最小延迟作为无排队时的基准,短期延迟明显高于基准时说明请求开始排队,按比例降低并发上限,
+// 延迟正常时在当前上限的基础上增加sqrt(limit)的余量,从而逐步探测服务能够承受的并发数
+type AdaptiveLimiter struct {
+	cfg AdaptiveLimiterConfig
+
+	limit    float64
+	inflight int
+	//无排队时的基准延迟,单位为秒
+	baseRTT float64
+	//当前采样周期内的延迟之和与数量
+	windowStart time.Time
+	windowSum   float64
+	windowCount int
+	//当前采样周期内的最大并发数,只有并发数接近上限时才会提高上限
+	windowMaxInflight int
+	lock              sync.Mutex
+}
+
+func NewAdaptiveLimiter(cfg *AdaptiveLimiterConfig) *AdaptiveLimiter {
+	c := cfg.withDefaults()
+	return &AdaptiveLimiter{
+		cfg:         c,
+		limit:       float64(c.InitialLimit),
+		windowStart: time.Now(),
+	}
+}
+
+// Limit返回当前的并发上限
+func (l *AdaptiveLimiter) Limit() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int(l.limit)
+}
+
+// Inflight返回正在处理的请求数
+func (l *AdaptiveLimiter) Inflight() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.inflight
+}
+
+// Acquire尝试占用一个并发名额,成功时返回的release必须在请求结束后调用
+func (l *AdaptiveLimiter) Acquire() (release func(), ok bool) {
+	l.lock.Lock()
+	if l.inflight >= int(l.limit) {
+		l.lock.Unlock()
+		return nil, false
+	}
+	l.inflight++
+	l.windowMaxInflight = max(l.windowMaxInflight, l.inflight)
+	l.lock.Unlock()
+
+	start := time.Now()
+	return func() {
+		l.release(time.Since(start))
+	}, true
+}
+
+func (l *AdaptiveLimiter) release(rtt time.Duration) {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.inflight--
+	l.windowSum += rtt.Seconds()
+	l.windowCount++
+	if now.Sub(l.windowStart) < l.cfg.Window {
+		return
+	}
+
+	shortRTT := l.windowSum / float64(l.windowCount)
+	maxInflight := l.windowMaxInflight
+	l.windowStart, l.windowSum, l.windowCount, l.windowMaxInflight = now, 0, 0, l.inflight
+	//基准延迟取观察到的最小延迟,并缓慢上浮,从而在下游整体变慢后也能逐渐适应新的延迟
+	if l.baseRTT == 0 || shortRTT < l.baseRTT {
+		l.baseRTT = shortRTT
+	} else {
+		l.baseRTT *= 1.002
+	}
+
+	gradient := max(0.5, min(1.0, l.cfg.Tolerance*l.baseRTT/shortRTT))
+	newLimit := l.limit * gradient
+	//并发数远低于上限时延迟不能反映上限是否合适,此时不提高上限
+	if float64(maxInflight) >= l.limit/2 {
+		newLimit += math.Sqrt(l.limit)
+	}
+	newLimit = l.limit*(1-l.cfg.Smoothing) + newLimit*l.cfg.Smoothing
+	newLimit = min(max(newLimit, float64(l.cfg.MinLimit)), float64(l.cfg.MaxLimit))
+	if int(newLimit) != int(l.limit) {
+		log.Debugf("[rpcserver] 并发上限调整为%d,短期延迟%.2fms,基准延迟%.2fms", int(newLimit), shortRTT*1000, l.baseRTT*1000)
+	}
+	l.limit = newLimit
+}
+
+// UnaryServerInterceptor超过并发上限的请求直接返回ResourceExhausted
+func (l *AdaptiveLimiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	critical := methodSet(l.cfg.CriticalMethods)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if isCritical(ctx, info.FullMethod, critical, l.cfg.TrustPriority) {
+			return handler(ctx, req)
+		}
+		release, ok := l.Acquire()
+		if !ok {
+			return nil, shedError(ctx, "服务器并发数已达上限,请稍后再试", l.cfg.RetryAfter)
+		}
+		defer release()
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor限制同时处理的流的数量,流的持续时间不参与延迟的统计
+func (l *AdaptiveLimiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	critical := methodSet(l.cfg.CriticalMethods)
+	return func(svr any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if isCritical(ss.Context(), info.FullMethod, critical, l.cfg.TrustPriority) {
+			return handler(svr, ss)
+		}
+		l.lock.Lock()
+		if l.inflight >= int(l.limit) {
+			l.lock.Unlock()
+			return shedError(ss.Context(), "服务器并发数已达上限,请稍后再试", l.cfg.RetryAfter)
+		}
+		l.inflight++
+		l.lock.Unlock()
+		defer func() {
+			l.lock.Lock()
+			l.inflight--
+			l.lock.Unlock()
+		}()
+		return handler(svr, ss)
+	}
+}
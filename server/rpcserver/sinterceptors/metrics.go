@@ -0,0 +1,91 @@
+package sinterceptors
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// rpc服务端的prometheus指标,在第一次使用metrics拦截器时注册到prometheus.DefaultRegisterer
+var (
+	serverHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goken",
+		Subsystem: "rpc_server",
+		Name:      "handled_total",
+		Help:      "rpc服务端完成的请求数",
+	}, []string{"method", "type", "code"})
+
+	serverHandlingSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "goken",
+		Subsystem: "rpc_server",
+		Name:      "handling_seconds",
+		Help:      "rpc服务端处理请求的耗时",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"method", "type"})
+
+	serverInflight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goken",
+		Subsystem: "rpc_server",
+		Name:      "inflight",
+		Help:      "rpc服务端正在处理的请求数",
+	}, []string{"method", "type"})
+
+	metricsOnce sync.Once
+)
+
+func registerMetrics() {
+	metricsOnce.Do(func() {
+		serverHandled = registerCollector(serverHandled)
+		serverHandlingSeconds = registerCollector(serverHandlingSeconds)
+		serverInflight = registerCollector(serverInflight)
+	})
+}
+
+// registerCollector注册c,使用者提前注册过相同的指标时返回已经注册的那个,
+// 否则数据会被记录到一个没有注册的collector中而无法被采集
+func registerCollector[T prometheus.Collector](c T) T {
+	if err := prometheus.Register(c); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			panic(err)
+		}
+		existing, ok := are.ExistingCollector.(T)
+		if !ok {
+			panic(err)
+		}
+		return existing
+	}
+	return c
+}
+
+// UnaryMetricsInterceptor统计一元请求的数量,耗时与状态码
+func UnaryMetricsInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	done := observe(info.FullMethod, "unary")
+	resp, err := handler(ctx, req)
+	done(err)
+	return resp, err
+}
+
+// StreamMetricsInterceptor统计流式请求的数量,耗时与状态码,耗时为整个流的持续时间
+func StreamMetricsInterceptor(svr any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	done := observe(info.FullMethod, "stream")
+	err := handler(svr, ss)
+	done(err)
+	return err
+}
+
+func observe(method string, kind string) func(error) {
+	registerMetrics()
+	start := time.Now()
+	inflight := serverInflight.WithLabelValues(method, kind)
+	inflight.Inc()
+	return func(err error) {
+		inflight.Dec()
+		serverHandled.WithLabelValues(method, kind, status.Code(err).String()).Inc()
+		serverHandlingSeconds.WithLabelValues(method, kind).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,93 @@
+package sinterceptors
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// 请求metadata中表示优先级的header,值为PriorityCritical且调用者可信的请求不会被限流器与过载保护拒绝
+const (
+	PriorityHeader   = "x-goken-priority"
+	PriorityCritical = "critical"
+)
+
+// gRPC原生的重试退避提示,客户端按该trailer指定的毫秒数等待后再重试
+const retryPushbackTrailer = "grpc-retry-pushback-ms"
+
+// TrustFunc判断请求的调用者是否可信,只有可信调用者携带的优先级header才会生效
+type TrustFunc func(ctx context.Context) bool
+
+// TrustPeerCertificate信任客户端证书的CommonName或DNS SAN为names之一的调用者,
+// 只检查经过校验的证书链,因此服务端需要开启mTLS并校验客户端证书
+func TrustPeerCertificate(names ...string) TrustFunc {
+	set := methodSet(names)
+	return func(ctx context.Context) bool {
+		p, ok := peer.FromContext(ctx)
+		if !ok {
+			return false
+		}
+		info, ok := p.AuthInfo.(credentials.TLSInfo)
+		if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+			return false
+		}
+		cert := info.State.VerifiedChains[0][0]
+		if _, ok := set[cert.Subject.CommonName]; ok {
+			return true
+		}
+		for _, name := range cert.DNSNames {
+			if _, ok := set[name]; ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// isCritical判断请求是否可以绕过限流,健康检查与critical中的方法均可绕过,
+// 带有critical优先级的请求只有在trust判断调用者可信时才能绕过,trust为nil时忽略该header
+func isCritical(ctx context.Context, method string, critical map[string]struct{}, trust TrustFunc) bool {
+	if method == healthCheckMethod {
+		return true
+	}
+	if _, ok := critical[method]; ok {
+		return true
+	}
+	if trust == nil {
+		return false
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(PriorityHeader) {
+		if v == PriorityCritical {
+			return trust(ctx)
+		}
+	}
+	return false
+}
+
+func methodSet(methods []string) map[string]struct{} {
+	m := make(map[string]struct{}, len(methods))
+	for _, v := range methods {
+		m[v] = struct{}{}
+	}
+	return m
+}
+
+// shedError返回ResourceExhausted错误,并通过RetryInfo与grpc-retry-pushback-ms告诉客户端多久之后再重试
+func shedError(ctx context.Context, msg string, retryAfter time.Duration) error {
+	grpc.SetTrailer(ctx, metadata.Pairs(retryPushbackTrailer, strconv.FormatInt(retryAfter.Milliseconds(), 10)))
+	st := status.New(codes.ResourceExhausted, msg)
+	if ds, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)}); err == nil {
+		st = ds
+	}
+	return st.Err()
+}
@@ -0,0 +1,36 @@
+package sinterceptors
+
+import (
+	"context"
+	"runtime/debug"
+
+	errors "github.com/hkensame/goken/pkg/errors"
+	"github.com/hkensame/goken/pkg/log"
+
+	"google.golang.org/grpc"
+)
+
+// UnaryRecoveryInterceptor捕获handler中的panic,记录堆栈后返回CodeInternalError,避免单个请求导致整个进程退出
+func UnaryRecoveryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = recoverFrom(ctx, info.FullMethod, p)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// StreamRecoveryInterceptor捕获流式handler中的panic
+func StreamRecoveryInterceptor(svr any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = recoverFrom(ss.Context(), info.FullMethod, p)
+		}
+	}()
+	return handler(svr, ss)
+}
+
+func recoverFrom(ctx context.Context, method string, p any) error {
+	log.ErrorwContext(ctx, "[rpcserver] 请求处理时发生panic", "method", method, "panic", p, "stack", string(debug.Stack()))
+	return errors.WithCoder(errors.Errorf("panic: %v", p), errors.CodeInternalError, "")
+}
@@ -0,0 +1,126 @@
+package sinterceptors
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/hkensame/goken/pkg/log"
+
+	"google.golang.org/grpc"
+)
+
+// CPUShedderConfig是基于CPU使用率的过载保护配置,零值字段使用默认值
+type CPUShedderConfig struct {
+	//CPU使用率(0到1,相对于GOMAXPROCS)超过该值后开始丢弃请求,默认为0.8
+	Threshold float64
+	//CPU使用率的采样间隔,默认为250ms
+	Interval time.Duration
+	//被丢弃的请求建议客户端等待的时间,默认为1s
+	RetryAfter time.Duration
+	//不受过载保护影响的方法全名
+	CriticalMethods []string
+	//判断携带x-goken-priority: critical的请求是否来自可信的调用者,例如TrustPeerCertificate,
+	//为nil时忽略该header,只有健康检查与CriticalMethods不受过载保护影响
+	TrustPriority TrustFunc
+}
+
+func (c *CPUShedderConfig) withDefaults() CPUShedderConfig {
+	cfg := CPUShedderConfig{}
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.Threshold <= 0 || cfg.Threshold >= 1 {
+		cfg.Threshold = 0.8
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Millisecond * 250
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = time.Second
+	}
+	return cfg
+}
+
+// CPUShedder周期性地采样进程的CPU使用率,使用率超过阈值后按超出的比例随机丢弃请求,
+// 使用率越高丢弃的比例越大,使用率达到100%时丢弃所有非关键请求
+type CPUShedder struct {
+	cfg CPUShedderConfig
+	//平滑后的CPU使用率,math.Float64bits编码
+	usage atomic.Uint64
+}
+
+// NewCPUShedder创建CPUShedder并开始采样,ctx结束后停止采样
+func NewCPUShedder(ctx context.Context, cfg *CPUShedderConfig) *CPUShedder {
+	s := &CPUShedder{cfg: cfg.withDefaults()}
+	go s.sample(ctx)
+	return s
+}
+
+// Usage返回最近的CPU使用率,不支持采样的平台上总是为0
+func (s *CPUShedder) Usage() float64 {
+	return math.Float64frombits(s.usage.Load())
+}
+
+// Allow判断是否放行一个请求
+func (s *CPUShedder) Allow() bool {
+	usage := s.Usage()
+	if usage <= s.cfg.Threshold {
+		return true
+	}
+	drop := (usage - s.cfg.Threshold) / (1 - s.cfg.Threshold)
+	return rand.Float64() >= drop
+}
+
+func (s *CPUShedder) sample(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	lastCPU, lastTime := processCPUTime(), time.Now()
+	var usage float64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			cpu := processCPUTime()
+			elapsed := now.Sub(lastTime)
+			if elapsed <= 0 || cpu < lastCPU {
+				lastCPU, lastTime = cpu, now
+				continue
+			}
+			cur := float64(cpu-lastCPU) / float64(elapsed) / float64(runtime.GOMAXPROCS(0))
+			lastCPU, lastTime = cpu, now
+			//指数平均,避免瞬时的尖刺触发丢弃
+			usage = usage*0.8 + min(cur, 1)*0.2
+			if usage > s.cfg.Threshold && s.Usage() <= s.cfg.Threshold {
+				log.Warnf("[rpcserver] CPU使用率%.2f超过阈值%.2f,开始丢弃请求", usage, s.cfg.Threshold)
+			}
+			s.usage.Store(math.Float64bits(usage))
+		}
+	}
+}
+
+// UnaryServerInterceptor在CPU过载时丢弃请求并返回ResourceExhausted
+func (s *CPUShedder) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	critical := methodSet(s.cfg.CriticalMethods)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if !isCritical(ctx, info.FullMethod, critical, s.cfg.TrustPriority) && !s.Allow() {
+			return nil, shedError(ctx, "服务器负载过高,请稍后再试", s.cfg.RetryAfter)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor在CPU过载时拒绝建立新的流
+func (s *CPUShedder) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	critical := methodSet(s.cfg.CriticalMethods)
+	return func(svr any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !isCritical(ss.Context(), info.FullMethod, critical, s.cfg.TrustPriority) && !s.Allow() {
+			return shedError(ss.Context(), "服务器负载过高,请稍后再试", s.cfg.RetryAfter)
+		}
+		return handler(svr, ss)
+	}
+}
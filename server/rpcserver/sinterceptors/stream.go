@@ -0,0 +1,172 @@
+package sinterceptors
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StreamPolicyConf定义流式请求的限制,零值字段表示不限制
+type StreamPolicyConf struct {
+	FullMethod string
+	//连续多久没有收发任何消息后结束流
+	IdleTimeout time.Duration
+	//流的最长持续时间
+	MaxDuration time.Duration
+	//最多接收的消息数
+	MaxMessages int
+	//每秒最多接收的消息数,超过后RecvMsg会等待,等待超过1s(或IdleTimeout)后结束流
+	MessageRate float64
+	//接收消息的突发上限,默认与MessageRate相同
+	MessageBurst int
+}
+
+var (
+	errStreamIdle        = status.Error(codes.DeadlineExceeded, "流空闲超时")
+	errStreamMaxDuration = status.Error(codes.DeadlineExceeded, "流超过最长持续时间")
+	errStreamMaxMessages = status.Error(codes.ResourceExhausted, "流接收的消息数超过上限")
+	errStreamRateLimited = status.Error(codes.ResourceExhausted, "流接收消息的速率超过上限")
+)
+
+// StreamPolicyInterceptor按照FullMethod为流式请求设置空闲超时,最长持续时间,消息数与消息速率的限制,
+// 没有单独配置的方法使用def.
+// 超出限制时传给handler的流的ctx会被取消,之后的RecvMsg与SendMsg都返回超出限制的原因,
+// 阻塞在RecvMsg上的handler也会立即返回,此时传给RecvMsg的m不能再被使用
+func StreamPolicyInterceptor(def StreamPolicyConf, methodPolicies ...StreamPolicyConf) grpc.StreamServerInterceptor {
+	pm := make(map[string]StreamPolicyConf, len(methodPolicies))
+	for _, p := range methodPolicies {
+		if p.FullMethod != "" {
+			pm[p.FullMethod] = p
+		}
+	}
+	return func(svr any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		p, ok := pm[info.FullMethod]
+		if !ok {
+			p = def
+		}
+		if p.IdleTimeout <= 0 && p.MaxDuration <= 0 && p.MaxMessages <= 0 && p.MessageRate <= 0 {
+			return handler(svr, ss)
+		}
+
+		ctx, cancel := context.WithCancelCause(ss.Context())
+		defer cancel(nil)
+		ps := &policyStream{ServerStream: ss, ctx: ctx, cancel: cancel, policy: p}
+		if p.MessageRate > 0 {
+			burst := p.MessageBurst
+			if burst <= 0 {
+				burst = max(int(p.MessageRate), 1)
+			}
+			ps.bucket = ratelimit.NewBucketWithRate(p.MessageRate, int64(burst))
+		}
+		if p.MaxDuration > 0 {
+			t := time.AfterFunc(p.MaxDuration, func() { cancel(errStreamMaxDuration) })
+			defer t.Stop()
+		}
+		if p.IdleTimeout > 0 {
+			ps.idle = time.AfterFunc(p.IdleTimeout, func() { cancel(errStreamIdle) })
+			defer ps.idle.Stop()
+		}
+
+		err := handler(svr, ps)
+		//超出限制后以限制的原因结束流,handler返回的错误通常只是RecvMsg或SendMsg给出的同一个原因
+		if cerr := ps.err(); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+type policyStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	policy StreamPolicyConf
+	idle   *time.Timer
+	bucket *ratelimit.Bucket
+	recv   atomic.Int64
+	lock   sync.Mutex
+}
+
+func (s *policyStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *policyStream) touch() {
+	if s.idle != nil {
+		s.lock.Lock()
+		s.idle.Reset(s.policy.IdleTimeout)
+		s.lock.Unlock()
+	}
+}
+
+// err返回流被取消的原因,调用者断开连接时返回其对应的错误
+func (s *policyStream) err() error {
+	if s.ctx.Err() == nil {
+		return nil
+	}
+	if cause := context.Cause(s.ctx); cause != nil && s.ServerStream.Context().Err() == nil {
+		return cause
+	}
+	return status.FromContextError(s.ServerStream.Context().Err()).Err()
+}
+
+func (s *policyStream) RecvMsg(m any) error {
+	if err := s.err(); err != nil {
+		return err
+	}
+	if err := s.recvMsg(m); err != nil {
+		return err
+	}
+	s.touch()
+	if n := s.recv.Add(1); s.policy.MaxMessages > 0 && n > int64(s.policy.MaxMessages) {
+		s.cancel(errStreamMaxMessages)
+		return errStreamMaxMessages
+	}
+	if s.bucket != nil {
+		wait := time.Second
+		if s.policy.IdleTimeout > 0 {
+			wait = s.policy.IdleTimeout
+		}
+		if !s.bucket.WaitMaxDuration(1, wait) {
+			s.cancel(errStreamRateLimited)
+			return errStreamRateLimited
+		}
+	}
+	return nil
+}
+
+// recvMsg在配置了超时时不会一直阻塞,流被取消后立即返回,
+// 之后的RecvMsg都会直接返回错误,因此不会出现并发的RecvMsg,
+// 仍在等待的底层RecvMsg会在handler返回,流结束后退出
+func (s *policyStream) recvMsg(m any) error {
+	if s.policy.IdleTimeout <= 0 && s.policy.MaxDuration <= 0 {
+		return s.ServerStream.RecvMsg(m)
+	}
+	ch := make(chan error, 1)
+	go func() {
+		ch <- s.ServerStream.RecvMsg(m)
+	}()
+	select {
+	case err := <-ch:
+		return err
+	case <-s.ctx.Done():
+		return s.err()
+	}
+}
+
+func (s *policyStream) SendMsg(m any) error {
+	if err := s.err(); err != nil {
+		return err
+	}
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.touch()
+	}
+	return err
+}